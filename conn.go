@@ -49,6 +49,22 @@ func BaseConn(conn net.Conn) net.Conn {
 	return conn
 }
 
+// findConn returns the first connection of the chain of wrappers starting at
+// conn for which match returns true, or nil if there are none. The chain is
+// followed the same way as in BaseConn.
+func findConn(conn net.Conn, match func(net.Conn) bool) net.Conn {
+	for {
+		if match(conn) {
+			return conn
+		}
+		b, ok := conn.(baseConn)
+		if !ok {
+			return nil
+		}
+		conn = b.BaseConn()
+	}
+}
+
 // BasePacketConn returns the base connection object of conn.
 //
 // The function works by dynamically checking whether conn implements the
@@ -81,3 +97,24 @@ type basePacketConn interface {
 type fileConn interface {
 	File() (*os.File, error)
 }
+
+// replayConn is a connection wrapper which returns bytes that were already read
+// from the connection before reading more, it is used by handlers that need to
+// peek at the beginning of a stream before passing the connection on.
+type replayConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *replayConn) BaseConn() net.Conn {
+	return c.Conn
+}
+
+func (c *replayConn) Read(b []byte) (n int, err error) {
+	if len(c.buf) != 0 {
+		n = copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return
+	}
+	return c.Conn.Read(b)
+}
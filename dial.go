@@ -0,0 +1,229 @@
+package netx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Dial is the counterpart of Listen, it connects to address, guessing the
+// network from the address.
+//
+// The function accepts the same address formats as Listen, see Dialer for
+// details.
+func Dial(address string) (net.Conn, error) {
+	return DialContext(context.Background(), address)
+}
+
+// DialContext is like Dial but takes a context to cancel the attempt to
+// connect.
+func DialContext(ctx context.Context, address string) (net.Conn, error) {
+	return (&Dialer{}).DialContext(ctx, "", address)
+}
+
+// A Dialer contains options for connecting to addresses.
+//
+// Addresses may be prefixed by a URL scheme to set the protocol that will be
+// used, supported protocols are tcp, tcp4, tcp6, udp, udp4, udp6, unix,
+// unixpacket, unixgram, and fd. The protocol found in the address takes
+// precedence over the network passed to the Dial and DialContext methods, which
+// means that a Dialer can be used as dialing function of a Tunnel or a
+// httpx.ConnTransport to redirect connections to any of these protocols.
+//
+// The fd protocol expects the number of a file descriptor referencing a
+// connected socket.
+//
+// When no protocol or network is set, the address is expected to be a pair of
+// host and port (or just a port to connect to the local system), or the path
+// to a unix domain socket. Like with Listen, the address is only used as a
+// path if it contains a '/', ends with ".sock", or starts with '@' (abstract
+// socket names, linux only).
+//
+// The network interface that the local end of connections is bound to may be
+// set with the "interface" option in the query string at the end of the
+// address, for example "tcp://10.0.0.1:4242?interface=eth0".
+type Dialer struct {
+	// Dialer is the dialer used to establish network connections, it may be
+	// used to configure timeouts, keep-alives, or the local address.
+	net.Dialer
+
+	// Interface is the name of the network interface that the local end of
+	// connections is bound to. The option is ignored for unix domain sockets.
+	Interface string
+}
+
+// Dial connects to address, see DialContext for details.
+func (d *Dialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address using network, unless the address contains
+// a protocol which is used instead.
+//
+// The method signature matches the DialContext fields of the Tunnel and
+// httpx.ConnTransport types.
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (conn net.Conn, err error) {
+	var ifname string
+
+	if address, ifname, err = splitDialOptions(address, d.Interface); err != nil {
+		return
+	}
+
+	if network, address, err = resolveDial(network, address); err != nil {
+		return
+	}
+
+	if network == "fd" {
+		return dialFD(address)
+	}
+
+	dialer := d.Dialer
+
+	if len(ifname) != 0 && !strings.HasPrefix(network, "unix") {
+		if network, dialer.LocalAddr, err = bindInterface(network, address, ifname); err != nil {
+			return
+		}
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// splitDialOptions splits the query string from address and returns the name
+// of the network interface set in the options, or ifname if none was set.
+func splitDialOptions(address string, ifname string) (string, string, error) {
+	i := strings.LastIndexByte(address, '?')
+	if i < 0 {
+		return address, ifname, nil
+	}
+
+	query, err := url.ParseQuery(address[i+1:])
+	if err != nil {
+		return address, ifname, errors.New("invalid options in " + address + ": " + err.Error())
+	}
+	address = address[:i]
+
+	for name, values := range query {
+		switch name {
+		case "interface":
+			ifname = values[len(values)-1]
+		default:
+			return address, ifname, errors.New("unsupported dial option: " + name)
+		}
+	}
+
+	return address, ifname, nil
+}
+
+func resolveDial(network string, address string) (string, string, error) {
+	if off := strings.Index(address, "://"); off >= 0 {
+		network, address = address[:off], address[off+3:]
+
+		switch network {
+		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixpacket", "unixgram", "fd":
+		default:
+			return "", "", errors.New("unsupported protocol: " + network)
+		}
+	}
+
+	if len(network) == 0 {
+		if _, _, err := net.SplitHostPort(address); err == nil {
+			network = "tcp"
+		} else if isPath(address) {
+			network = "unix"
+		} else if len(address) != 0 {
+			return "", "", errors.New("missing port in address: " + address)
+		} else {
+			return "", "", errors.New("missing address")
+		}
+	}
+
+	if network == "fd" {
+		if _, err := strconv.Atoi(address); err != nil {
+			return "", "", errors.New("expected file descriptor number with fd:// protocol but found " + address)
+		}
+	}
+
+	return network, address, nil
+}
+
+// dialFD returns a connection for the connected socket referenced by the file
+// descriptor in address.
+func dialFD(address string) (conn net.Conn, err error) {
+	var f *os.File
+
+	if f, err = openFD("fd", address); err != nil {
+		return
+	}
+	defer f.Close()
+
+	return net.FileConn(f)
+}
+
+// bindInterface returns the local address to bind connections to in order to
+// connect to address from the network interface named ifname. The network may
+// be changed to restrict it to the address family of the interface.
+func bindInterface(network string, address string, ifname string) (string, net.Addr, error) {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return network, nil, err
+	}
+
+	ifa, err := ifi.Addrs()
+	if err != nil {
+		return network, nil, err
+	}
+
+	var ipv4 bool
+	var ipv6 bool
+
+	switch {
+	case strings.HasSuffix(network, "4"):
+		ipv4 = true
+	case strings.HasSuffix(network, "6"):
+		ipv6 = true
+	default:
+		host, _ := SplitAddrPort(address)
+		ipv4 = IsIPv4(host)
+		ipv6 = IsIPv6(host)
+		if !ipv4 && !ipv6 {
+			ipv4, ipv6 = true, true
+		}
+	}
+
+	for _, a := range ifa {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		zone := ""
+
+		if n.IP.IsLinkLocalUnicast() {
+			zone = ifi.Name
+		}
+
+		if n.IP.To4() != nil {
+			if !ipv4 {
+				continue
+			}
+			network = strings.TrimRight(network, "46") + "4"
+		} else {
+			if !ipv6 {
+				continue
+			}
+			network = strings.TrimRight(network, "46") + "6"
+		}
+
+		if strings.HasPrefix(network, "udp") {
+			return network, &net.UDPAddr{IP: n.IP, Zone: zone}, nil
+		}
+		return network, &net.TCPAddr{IP: n.IP, Zone: zone}, nil
+	}
+
+	return network, nil, fmt.Errorf("no address of the %s interface can be used to connect to %s://%s", ifname, network, address)
+}
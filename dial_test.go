@@ -0,0 +1,165 @@
+package netx
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestResolveDial(t *testing.T) {
+	tests := []struct {
+		network string
+		address string
+		net     string
+		addr    string
+	}{
+		{"", "127.0.0.1:4242", "tcp", "127.0.0.1:4242"},
+		{"", ":4242", "tcp", ":4242"},
+		{"", "localhost:4242", "tcp", "localhost:4242"},
+		{"", "/tmp/netx.sock", "unix", "/tmp/netx.sock"},
+		{"", "@netx", "unix", "@netx"},
+		{"", "udp://[::1]:53", "udp", "[::1]:53"},
+		{"", "fd://3", "fd", "3"},
+		{"tcp", "unix:///tmp/netx.sock", "unix", "/tmp/netx.sock"},
+		{"tcp", "example.com:80", "tcp", "example.com:80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			network, address, err := resolveDial(test.network, test.address)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if network != test.net {
+				t.Error("bad network:", network)
+			}
+
+			if address != test.addr {
+				t.Error("bad address:", address)
+			}
+		})
+	}
+}
+
+func TestResolveDialError(t *testing.T) {
+	for _, address := range []string{
+		"",
+		"localhost",
+		"10.0.0.1",
+		"systemd://http",
+		"fd://stdin",
+	} {
+		t.Run(address, func(t *testing.T) {
+			if _, _, err := resolveDial("", address); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDial(t *testing.T) {
+	addresses := []string{
+		"tcp://127.0.0.1:0",
+		"unix:///tmp/netx-dial.sock",
+	}
+
+	if runtime.GOOS == "linux" {
+		addresses = append(addresses, "unix://@netx-dial")
+	}
+
+	for _, address := range addresses {
+		t.Run(address, func(t *testing.T) {
+			lstn, err := Listen(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lstn.Close()
+
+			a := lstn.Addr()
+			conn, err := Dial(a.Network() + "://" + a.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			accepted, err := lstn.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted.Close()
+		})
+	}
+}
+
+func TestDialInterface(t *testing.T) {
+	ifi := loopbackInterface(t)
+
+	lstn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	conn, err := Dial("tcp://" + lstn.Addr().String() + "?interface=" + ifi.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Error("bad local address:", conn.LocalAddr())
+	}
+
+	if _, err := Dial("tcp://" + lstn.Addr().String() + "?interface=netx-nonexistent"); err == nil {
+		t.Error("expected an error when binding to an interface that doesn't exist")
+	}
+}
+
+func TestDialerTunnel(t *testing.T) {
+	lstn, err := Listen("unix:///tmp/netx-dial-tunnel.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	go func() {
+		conn, err := lstn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "Hello World!")
+	}()
+
+	c1, c2, err := ConnPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan struct{})
+
+	tunnel := &Tunnel{
+		Handler: TunnelHandlerFunc(func(ctx context.Context, from net.Conn, to net.Conn) {
+			defer close(done)
+			b := make([]byte, 12)
+			if _, err := io.ReadFull(to, b); err != nil {
+				t.Error(err)
+			} else if s := string(b); s != "Hello World!" {
+				t.Error("bad message:", s)
+			}
+		}),
+		DialContext: (&Dialer{}).DialContext,
+	}
+
+	tunnel.ServeProxy(context.Background(), c1, &NetAddr{
+		Net:  "tcp",
+		Addr: "unix:///tmp/netx-dial-tunnel.sock",
+	})
+	<-done
+}
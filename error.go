@@ -3,6 +3,7 @@ package netx
 import (
 	"errors"
 	"net"
+	"os"
 )
 
 // Timeout returns a new network error representing a timeout.
@@ -30,6 +31,18 @@ func IsTimeout(err error) bool {
 	return ok && e != nil && e.Timeout()
 }
 
+// syscallError returns the error returned by the system call that caused err,
+// which is usually a syscall.Errno.
+func syscallError(err error) error {
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err
+}
+
 var (
 	// ErrLineTooLong should be used by line-based protocol readers that detect
 	// a line longer than they were configured to handle.
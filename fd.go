@@ -0,0 +1,165 @@
+package netx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// openFD parses address as a file descriptor number and returns a file that
+// owns this descriptor.
+func openFD(scheme string, address string) (f *os.File, err error) {
+	var fd int
+
+	if fd, err = strconv.Atoi(address); err != nil {
+		err = errors.New("invalid file descriptor in " + scheme + "://" + address)
+		return
+	} else if fd < 0 {
+		err = errors.New("invalid negative file descriptor in " + scheme + "://" + address)
+		return
+	}
+
+	f = os.NewFile(uintptr(fd), scheme+"://"+address)
+	return
+}
+
+// socketInfo inspects the socket referenced by fd, returning its type, the
+// network name matching its domain and type, and whether it is listening.
+func socketInfo(fd int) (sotype int, network string, listening bool, err error) {
+	var sa syscall.Sockaddr
+	var acceptconn int
+
+	if sotype, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE); err != nil {
+		err = os.NewSyscallError("getsockopt", err)
+		return
+	}
+
+	if acceptconn, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); err != nil {
+		err = os.NewSyscallError("getsockopt", err)
+		return
+	}
+
+	// The socket domain is determined from its local address because the
+	// SO_DOMAIN option isn't available on all platforms.
+	if sa, err = syscall.Getsockname(fd); err != nil {
+		err = os.NewSyscallError("getsockname", err)
+		return
+	}
+
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		switch sotype {
+		case syscall.SOCK_STREAM:
+			network = "tcp4"
+		case syscall.SOCK_DGRAM:
+			network = "udp4"
+		case syscall.SOCK_RAW:
+			network = "ip4"
+		}
+
+	case *syscall.SockaddrInet6:
+		switch sotype {
+		case syscall.SOCK_STREAM:
+			network = "tcp6"
+		case syscall.SOCK_DGRAM:
+			network = "udp6"
+		case syscall.SOCK_RAW:
+			network = "ip6"
+		}
+
+	case *syscall.SockaddrUnix:
+		switch sotype {
+		case syscall.SOCK_STREAM:
+			network = "unix"
+		case syscall.SOCK_DGRAM:
+			network = "unixgram"
+		case syscall.SOCK_SEQPACKET:
+			network = "unixpacket"
+		}
+	}
+
+	if len(network) == 0 {
+		network = "unknown"
+	}
+
+	listening = acceptconn != 0
+	return
+}
+
+// listenFD returns a listener for the listening socket referenced by the file
+// descriptor in address.
+func listenFD(address string) (lstn net.Listener, err error) {
+	var f *os.File
+	var network string
+	var listening bool
+
+	if f, err = openFD("fd", address); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if _, network, listening, err = socketInfo(int(f.Fd())); err != nil {
+		err = fmt.Errorf("fd://%s: %s", address, err)
+		return
+	}
+
+	if !listening {
+		err = fmt.Errorf("fd://%s: the %s socket is not listening, use fdrecv:// to receive connections over a unix domain socket", address, network)
+		return
+	}
+
+	return net.FileListener(f)
+}
+
+// listenFDRecv returns a listener which receives connections over the unix
+// domain socket referenced by the file descriptor in address.
+func listenFDRecv(address string) (lstn net.Listener, err error) {
+	var f *os.File
+	var c net.Conn
+
+	if f, err = openFD("fdrecv", address); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if c, err = net.FileConn(f); err != nil {
+		return
+	}
+
+	u, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		err = fmt.Errorf("fdrecv://%s: the file descriptor is not a unix domain socket", address)
+		return
+	}
+
+	return NewRecvUnixListener(u), nil
+}
+
+// listenPacketFD returns a packet connection for the datagram socket referenced
+// by the file descriptor in address.
+func listenPacketFD(address string) (conn net.PacketConn, err error) {
+	var f *os.File
+	var sotype int
+	var network string
+
+	if f, err = openFD("fd", address); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if sotype, network, _, err = socketInfo(int(f.Fd())); err != nil {
+		err = fmt.Errorf("fd://%s: %s", address, err)
+		return
+	}
+
+	if sotype != syscall.SOCK_DGRAM && sotype != syscall.SOCK_RAW {
+		err = fmt.Errorf("fd://%s: the %s socket is not packet oriented", address, network)
+		return
+	}
+
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,130 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// dupFD returns the address of a duplicate of the file descriptor embedded in
+// the given object, prefixed with scheme.
+func dupFD(t *testing.T, scheme string, obj interface {
+	File() (*os.File, error)
+}) string {
+	f, err := obj.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return scheme + "://" + strconv.Itoa(fd)
+}
+
+func TestListenFD(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		lstn, err := Listen(dupFD(t, "fd", l.(*net.TCPListener)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lstn.Close()
+
+		if _, ok := lstn.(*net.TCPListener); !ok {
+			t.Errorf("bad listener type: %T", lstn)
+		}
+
+		if lstn.Addr().String() != l.Addr().String() {
+			t.Error("bad listener address:", lstn.Addr())
+		}
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		l, err := net.Listen("unix", "/tmp/netx-listen-fd.sock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		lstn, err := Listen(dupFD(t, "fd", l.(*net.UnixListener)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lstn.Close()
+
+		if _, ok := lstn.(*net.UnixListener); !ok {
+			t.Errorf("bad listener type: %T", lstn)
+		}
+	})
+
+	t.Run("not-listening", func(t *testing.T) {
+		u1, u2, err := UnixConnPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer u1.Close()
+		defer u2.Close()
+
+		if _, err := Listen(dupFD(t, "fd", u1)); err == nil {
+			t.Error("expected an error when passing a socket that isn't listening")
+		}
+	})
+}
+
+func TestListenFDRecv(t *testing.T) {
+	u1, u2, err := UnixConnPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u1.Close()
+	defer u2.Close()
+
+	lstn, err := Listen(dupFD(t, "fdrecv", u1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	if _, ok := lstn.(*RecvUnixListener); !ok {
+		t.Errorf("bad listener type: %T", lstn)
+	}
+}
+
+func TestListenPacketFD(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := ListenPacket(dupFD(t, "fd", c.(*net.UDPConn)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.LocalAddr().String() != c.LocalAddr().String() {
+		t.Error("bad connection address:", conn.LocalAddr())
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := ListenPacket(dupFD(t, "fd", l.(*net.TCPListener))); err == nil {
+		t.Error("expected an error when passing a stream socket")
+	}
+}
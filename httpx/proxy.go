@@ -50,6 +50,15 @@ type ReverseProxy struct {
 	// that happen over a secured link.
 	// If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
+
+	// ProxyHeader can be set to make the proxy send a proxy protocol header on
+	// the connections it opens for HTTP upgrades or CONNECT requests. The
+	// version and TLVs of the header are taken from this field, the source
+	// address is the remote address of the client connection and the
+	// destination address is the target of the request. When the target isn't
+	// made of an IP address and port (a host name for example), the local
+	// address of the client connection is used instead.
+	ProxyHeader *netx.ProxyHeader
 }
 
 // ServeHTTP satisfies the http.Handler interface.
@@ -77,7 +86,7 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// No target protocol was set, attempting to guess it from the port that the
 	// client is trying to connect to (fail later otherwise).
 	if len(outreq.URL.Scheme) == 0 {
-		outreq.URL.Scheme = guessScheme(localAddr, req.URL.Host)
+		outreq.URL.Scheme = guessScheme(contextLocalAddr(req.Context()), req.URL.Host)
 	}
 
 	// Remove hop-by-hop headers from the request so they aren't forwarded to
@@ -168,6 +177,11 @@ func (p *ReverseProxy) serveCONNECT(w http.ResponseWriter, req *http.Request) {
 	}
 	defer backend.Close()
 
+	if err := p.writeProxyHeader(backend, req); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
 	io.Copy(ioutil.Discard, req.Body)
 	req.Body.Close()
 	w.WriteHeader(http.StatusOK)
@@ -235,6 +249,11 @@ func (p *ReverseProxy) serveUpgrade(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	if err := p.writeProxyHeader(backend, req); err != nil {
+		backend.Close()
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
 	if req.URL.Scheme == "https" {
 		backend = tls.Client(backend, p.TLSClientConfig)
 	}
@@ -298,11 +317,33 @@ func (p *ReverseProxy) serveUpgrade(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// writeProxyHeader sends the proxy protocol header configured on p to backend,
+// with the address of the client that req was received from and the target of
+// the request.
+func (p *ReverseProxy) writeProxyHeader(backend net.Conn, req *http.Request) error {
+	if p.ProxyHeader == nil {
+		return nil
+	}
+	hdr := *p.ProxyHeader
+	hdr.SrcAddr = &netx.NetAddr{Net: "tcp", Addr: req.RemoteAddr}
+	hdr.DstAddr = contextLocalAddr(req.Context())
+	if host, _, err := net.SplitHostPort(req.URL.Host); err == nil && net.ParseIP(host) != nil {
+		hdr.DstAddr = &netx.NetAddr{Net: "tcp", Addr: req.URL.Host}
+	}
+	_, err := hdr.WriteTo(backend)
+	return err
+}
+
 // guessScheme attempts to guess the protocol that should be used for a proxied
 // request (either http or https).
-func guessScheme(localAddr string, remoteAddr string) string {
-	if scheme, _ := netx.SplitNetAddr(localAddr); scheme == "tls" {
-		return "https"
+func guessScheme(localAddr net.Addr, remoteAddr string) string {
+	if localAddr != nil {
+		if localAddr.Network() == "tls" {
+			return "https"
+		}
+		if scheme, _ := netx.SplitNetAddr(localAddr.String()); scheme == "tls" {
+			return "https"
+		}
 	}
 	switch _, port, _ := net.SplitHostPort(remoteAddr); port {
 	case "", "80":
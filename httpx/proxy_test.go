@@ -1,7 +1,13 @@
 package httpx
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/segmentio/netx"
@@ -33,3 +39,59 @@ func TestProxy(t *testing.T) {
 		}
 	})
 }
+
+func TestProxyCONNECTProxyHeader(t *testing.T) {
+	// The origin server writes the client and target addresses it got from
+	// the proxy protocol header.
+	origin, closeOrigin := listenAndServe(&netx.ProxyProtocol{
+		Handler: netx.HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			io.WriteString(conn, conn.RemoteAddr().String()+" "+conn.LocalAddr().String()+"\n")
+			conn.Close()
+		}),
+	})
+	defer closeOrigin()
+
+	proxy, closeProxy := listenAndServe(&Server{
+		Handler: &ReverseProxy{ProxyHeader: &netx.ProxyHeader{Version: 1}},
+	})
+	defer closeProxy()
+
+	_, originAddr := netx.SplitNetAddr(origin)
+	_, proxyAddr := netx.SplitNetAddr(proxy)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", originAddr, originAddr)
+	r := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("bad status:", res.Status)
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := strings.Fields(line)
+	if len(addrs) != 2 {
+		t.Fatal("bad addresses received by the origin server:", line)
+	}
+
+	if addrs[0] != conn.LocalAddr().String() {
+		t.Errorf("bad client address received by the origin server: %s != %s", conn.LocalAddr(), addrs[0])
+	}
+
+	if addrs[1] != originAddr {
+		t.Errorf("bad target address received by the origin server: %s != %s", originAddr, addrs[1])
+	}
+}
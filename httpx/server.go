@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"runtime/debug"
 	"strconv"
 	"time"
 
@@ -51,6 +52,22 @@ type Server struct {
 	// the log package's standard logger.
 	ErrorLog *log.Logger
 
+	// Logger receives the events reported by the server. If nil, the events
+	// are output to ErrorLog.
+	Logger netx.Logger
+
+	// PanicHandler is called when the handler panics while serving req on
+	// conn, it receives the recovered value and the stack trace of the
+	// goroutine that panicked. The function may write a response with w when
+	// the handler hadn't sent one yet, or panic again to crash the program (the
+	// panic is raised as a *netx.UnrecoverablePanic, which netx.Server doesn't
+	// recover).
+	// If nil, the panic is reported to the server's logger.
+	//
+	// The server responds with 500 Internal Server Error if neither the handler
+	// nor the PanicHandler wrote the response header.
+	PanicHandler func(w http.ResponseWriter, req *http.Request, conn net.Conn, err interface{}, stack []byte)
+
 	// ServerName is the name of the server, returned in the "Server" response
 	// header field.
 	ServerName string
@@ -81,7 +98,6 @@ func (s *Server) ServeConn(ctx context.Context, conn net.Conn) {
 	reqctx, cancel = context.WithCancel(reqctx)
 
 	sc := newServerConn(conn, cancel)
-	defer sc.Close()
 
 	res := &responseWriter{
 		header:  make(http.Header, 10),
@@ -90,6 +106,13 @@ func (s *Server) ServeConn(ctx context.Context, conn net.Conn) {
 	}
 	copyHeader(res.header, baseHeader)
 
+	defer func() {
+		// Hijacked connections are owned by the handler that took them over.
+		if res.err != http.ErrHijacked {
+			sc.Close()
+		}
+	}()
+
 	for {
 		var req *http.Request
 		var err error
@@ -101,6 +124,7 @@ func (s *Server) ServeConn(ctx context.Context, conn net.Conn) {
 		if req, err = sc.readRequest(reqctx, maxHeaderBytes, s.ReadTimeout); err != nil {
 			return
 		}
+		netx.SetConnState(conn, netx.StateActive)
 		res.req = req
 
 		if closed = req.Close; closed {
@@ -126,6 +150,7 @@ func (s *Server) ServeConn(ctx context.Context, conn net.Conn) {
 		req.Body.Close()
 
 		res.reset(baseHeader)
+		netx.SetConnState(conn, netx.StateIdle)
 	}
 }
 
@@ -164,23 +189,50 @@ func (s *Server) ServeProxy(ctx context.Context, conn net.Conn, target net.Addr)
 	server.ServeConn(ctx, conn)
 }
 
+// handlePanic passes err to the server's panic handler. If the panic handler
+// panics again the value is wrapped in a *netx.UnrecoverablePanic so the
+// program crashes instead of having the panic recovered by a netx.Server.
+func (s *Server) handlePanic(w http.ResponseWriter, req *http.Request, conn net.Conn, err interface{}) {
+	if p, ok := err.(*netx.UnrecoverablePanic); ok {
+		panic(p)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			if _, ok := v.(*netx.UnrecoverablePanic); !ok {
+				v = &netx.UnrecoverablePanic{Value: v, Stack: debug.Stack()}
+			}
+			panic(v)
+		}
+	}()
+
+	s.PanicHandler(w, req, conn, err, debug.Stack())
+}
+
 func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request, conn net.Conn) {
 	defer func() {
 		res := w.(*responseWriter)
 		err := recover()
 
 		if err != nil {
-			netx.Recover(err, conn, s.ErrorLog)
+			status := res.status
+
+			if s.PanicHandler == nil {
+				netx.RecoverLogger(err, conn, s.logger())
+			} else {
+				s.handlePanic(w, req, conn, err)
+			}
 
 			// If the header wasn't written yet when the error occurred we can
 			// attempt to keep using the connection, otherwise we abort to
 			// notify the client that something went wrong.
-			if res.status == 0 {
-				res.WriteHeader(http.StatusInternalServerError)
-			} else {
+			if status != 0 {
 				req.Close = true
 				return
 			}
+			if res.status == 0 {
+				res.WriteHeader(http.StatusInternalServerError)
+			}
 		}
 
 		res.close()
@@ -205,6 +257,13 @@ func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request, conn net.Co
 	handler.ServeHTTP(w, req)
 }
 
+func (s *Server) logger() netx.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return netx.NewLogger(s.ErrorLog)
+}
+
 // serverConn is a net.Conn that embeds a I/O buffers and a connReader, this is
 // mainly used as an optimization to reduce the number of dynamic memory
 // allocations.
@@ -269,6 +328,7 @@ func (conn *serverConn) readRequest(ctx context.Context, maxHeaderBytes int, tim
 		return
 	}
 	req = req.WithContext(ctx)
+	req.RemoteAddr = conn.RemoteAddr().String()
 
 	// Drop the size limit on the connection reader to let the request body
 	// go through.
@@ -315,6 +375,7 @@ func (res *responseWriter) Hijack() (conn net.Conn, rw *bufio.ReadWriter, err er
 
 	// Cancel all deadlines on the connection before returning it.
 	conn.SetDeadline(time.Time{})
+	netx.SetConnState(conn, netx.StateHijacked)
 	return
 }
 
@@ -2,7 +2,10 @@ package httpx
 
 import (
 	"context"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"testing"
 
@@ -21,6 +24,64 @@ func TestServer(t *testing.T) {
 	})
 }
 
+func TestServerPanicHandler(t *testing.T) {
+	url, close := listenAndServe(&Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			panic("oops")
+		}),
+		PanicHandler: func(w http.ResponseWriter, req *http.Request, conn net.Conn, err interface{}, stack []byte) {
+			if err != "oops" {
+				t.Error("bad recovered value:", err)
+			}
+			if len(stack) == 0 {
+				t.Error("no stack trace")
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+	defer close()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("bad status code:", res.StatusCode)
+	}
+}
+
+func TestServerPanicHandlerCrash(t *testing.T) {
+	c1, c2, err := netx.ConnPair("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	server := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			panic("oops")
+		}),
+		PanicHandler: func(w http.ResponseWriter, req *http.Request, conn net.Conn, err interface{}, stack []byte) {
+			panic("crash")
+		},
+	}
+
+	go io.WriteString(c2, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// The value must be wrapped so netx.Server raises it again instead of
+	// recovering it.
+	defer func() {
+		if p, ok := recover().(*netx.UnrecoverablePanic); !ok || p.Value != "crash" || len(p.Stack) == 0 {
+			t.Error("the panic handler did not crash the server:", p)
+		}
+	}()
+
+	server.ServeConn(context.Background(), c1)
+}
+
 func listenAndServe(h netx.Handler) (url string, close func()) {
 	lstn, err := netx.Listen("127.0.0.1:0")
 	if err != nil {
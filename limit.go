@@ -0,0 +1,192 @@
+package netx
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A SourceLimiter limits the rate at which connections are accepted from a
+// single source, and how many connections from that source may be served
+// concurrently.
+//
+// Sources are identified by the IP address of the remote end of connections,
+// masked with IPv4PrefixLen or IPv6PrefixLen so a whole network (for example a
+// /24 in IPv4 or a /64 in IPv6) can be treated as a single source. Connections
+// that don't have an IP address (like unix domain sockets) are not limited.
+//
+// A SourceLimiter is safe to use concurrently from multiple goroutines, and may
+// be shared by multiple servers.
+type SourceLimiter struct {
+	// Rate is the number of connections per second that a source is allowed
+	// to open. Zero means no rate limit.
+	Rate float64
+
+	// Burst is the maximum number of connections that a source may open at
+	// once when it hasn't reached its rate limit. If zero, the burst is set to
+	// the rate.
+	Burst int
+
+	// MaxConns is the maximum number of concurrent connections from a single
+	// source. Zero means no limit.
+	MaxConns int
+
+	// IPv4PrefixLen and IPv6PrefixLen are the lengths of the prefixes that
+	// identify sources. Zero means to use the full address.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	mutex    sync.Mutex
+	sources  map[string]*source
+	rejected uint64
+	sweep    time.Time
+}
+
+// source carries the state maintained by a SourceLimiter for a single source.
+type source struct {
+	conns  int       // number of active connections
+	tokens float64   // tokens available in the bucket
+	time   time.Time // last time the tokens were refilled
+}
+
+// Acquire is called when a connection is accepted from addr, it returns true if
+// the connection is allowed, in which case the program must call Release when
+// the connection is closed.
+func (l *SourceLimiter) Acquire(addr net.Addr) bool {
+	key, ok := l.key(addr)
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.sweep) >= time.Minute {
+		l.sweepSources(now)
+	}
+
+	if l.sources == nil {
+		l.sources = make(map[string]*source)
+	}
+
+	s := l.sources[key]
+
+	if s == nil {
+		s = &source{tokens: l.burst(), time: now}
+		l.sources[key] = s
+	}
+
+	if l.MaxConns > 0 && s.conns >= l.MaxConns {
+		l.rejected++
+		return false
+	}
+
+	if l.Rate > 0 {
+		l.refill(s, now)
+
+		if s.tokens < 1 {
+			l.rejected++
+			return false
+		}
+
+		s.tokens--
+	}
+
+	s.conns++
+	return true
+}
+
+// Release must be called when a connection that was allowed by Acquire is
+// closed.
+func (l *SourceLimiter) Release(addr net.Addr) {
+	key, ok := l.key(addr)
+	if !ok {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s := l.sources[key]; s != nil && s.conns > 0 {
+		s.conns--
+	}
+}
+
+// Rejected returns the number of connections that were rejected by l.
+func (l *SourceLimiter) Rejected() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rejected
+}
+
+func (l *SourceLimiter) key(addr net.Addr) (string, bool) {
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return "", false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if n := l.IPv4PrefixLen; n > 0 && n < 32 {
+			ip4 = ip4.Mask(net.CIDRMask(n, 32))
+		}
+		return string(ip4), true
+	}
+
+	if ip16 := ip.To16(); ip16 != nil {
+		if n := l.IPv6PrefixLen; n > 0 && n < 128 {
+			ip16 = ip16.Mask(net.CIDRMask(n, 128))
+		}
+		return string(ip16), true
+	}
+
+	return "", false
+}
+
+func (l *SourceLimiter) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	if l.Rate < 1 {
+		return 1
+	}
+	return l.Rate
+}
+
+func (l *SourceLimiter) refill(s *source, now time.Time) {
+	s.tokens += now.Sub(s.time).Seconds() * l.Rate
+	s.time = now
+
+	if burst := l.burst(); s.tokens > burst {
+		s.tokens = burst
+	}
+}
+
+// sweepSources removes the sources that have no active connections and would
+// have a full bucket, they are indistinguishable from new sources.
+func (l *SourceLimiter) sweepSources(now time.Time) {
+	l.sweep = now
+
+	for key, s := range l.sources {
+		if s.conns != 0 {
+			continue
+		}
+		if l.Rate > 0 {
+			l.refill(s, now)
+
+			if s.tokens < l.burst() {
+				continue
+			}
+		}
+		delete(l.sources, key)
+	}
+}
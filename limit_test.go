@@ -0,0 +1,173 @@
+package netx
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSourceLimiterMaxConns(t *testing.T) {
+	l := &SourceLimiter{
+		MaxConns:      2,
+		IPv4PrefixLen: 24,
+		IPv6PrefixLen: 64,
+	}
+
+	a1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	a2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2}
+	a3 := &net.TCPAddr{IP: net.ParseIP("10.0.1.1"), Port: 3}
+	a4 := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 4}
+	a5 := &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 5}
+	a6 := &net.TCPAddr{IP: net.ParseIP("fe80::1:0:0:0:1"), Port: 6}
+	a7 := &net.UnixAddr{Net: "unix", Name: "/tmp/test.sock"}
+
+	tests := []struct {
+		addr    net.Addr
+		release bool
+		allowed bool
+	}{
+		{addr: a1, allowed: true},
+		{addr: a2, allowed: true},
+		{addr: a1, allowed: false}, // same /24 as a1 and a2
+		{addr: a3, allowed: true},
+		{addr: a2, release: true},
+		{addr: a1, allowed: true},
+		{addr: a4, allowed: true},
+		{addr: a5, allowed: true},
+		{addr: a4, allowed: false}, // same /64 as a4 and a5
+		{addr: a6, allowed: true},
+		{addr: a7, allowed: true},
+		{addr: a7, allowed: true},
+		{addr: a7, allowed: true},
+	}
+
+	for _, test := range tests {
+		if test.release {
+			l.Release(test.addr)
+			continue
+		}
+		if allowed := l.Acquire(test.addr); allowed != test.allowed {
+			t.Errorf("%s: bad allowed state: %t", test.addr, allowed)
+		}
+	}
+
+	if n := l.Rejected(); n != 2 {
+		t.Error("bad number of rejected connections:", n)
+	}
+}
+
+func TestSourceLimiterRate(t *testing.T) {
+	l := &SourceLimiter{
+		Rate:  10,
+		Burst: 2,
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}
+
+	for i, allowed := range []bool{true, true, false} {
+		if l.Acquire(addr) != allowed {
+			t.Errorf("#%d: expected allowed to be %t", i, allowed)
+		}
+	}
+
+	// Wait long enough for one token to be added to the bucket.
+	time.Sleep(150 * time.Millisecond)
+
+	for i, allowed := range []bool{true, false} {
+		if l.Acquire(addr) != allowed {
+			t.Errorf("#%d: expected allowed to be %t", i, allowed)
+		}
+	}
+}
+
+func TestServerLimiter(t *testing.T) {
+	lstn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := &Server{
+		Handler: Echo,
+		Context: ctx,
+		Limiter: &SourceLimiter{MaxConns: 1},
+	}
+	go server.Serve(lstn)
+
+	c1, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// Give a bit of time to the server to accept the first connection.
+	time.Sleep(50 * time.Millisecond)
+
+	c2, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	c2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	ioutil.ReadAll(c2) // EOF or connection reset
+
+	stats := server.Stats()
+
+	if stats.Accepted != 2 {
+		t.Error("bad number of accepted connections:", stats.Accepted)
+	}
+
+	if stats.Rejected != 1 {
+		t.Error("bad number of rejected connections:", stats.Rejected)
+	}
+
+	if stats.Conns != 1 {
+		t.Error("bad number of active connections:", stats.Conns)
+	}
+}
+
+func TestServerLimiterOverloadPause(t *testing.T) {
+	lstn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := &Server{
+		Handler:        Echo,
+		Context:        ctx,
+		MaxConns:       1,
+		OverloadPolicy: OverloadPause,
+		Limiter:        &SourceLimiter{Rate: 0.0001, Burst: 1},
+	}
+	go server.Serve(lstn)
+
+	// The first connection is allowed by the limiter, the next ones are
+	// rejected and must give back the slot acquired before accepting them,
+	// otherwise the server stops accepting connections.
+	for i := 0; i != 3; i++ {
+		conn, err := net.Dial("tcp", lstn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+		if _, err := ioutil.ReadAll(conn); IsTimeout(err) {
+			t.Fatalf("#%d: the connection was not accepted", i)
+		}
+
+		conn.Close()
+	}
+
+	if stats := server.Stats(); stats.Rejected != 2 {
+		t.Error("bad number of rejected connections:", stats.Rejected)
+	}
+}
@@ -1,94 +1,281 @@
 package netx
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 )
 
 // Listen is equivalent to net.Listen but guesses the network from the address.
 //
 // The function accepts addresses that may be prefixed by a URL scheme to set
 // the protocol that will be used, supported protocols are tcp, tcp4, tcp6,
-// unix, unixpacket, and fd.
+// unix, unixpacket, fd, fdrecv, systemd, and tls.
+//
+// The tls protocol creates TCP listeners which accept TLS connections, the
+// certificate is either set with the cert and key options or with the
+// TLSConfig field of a ListenConfig. The TLS handshake happens on the first
+// read or write on the accepted connections, and their local address reports
+// a "tls" network.
+//
+// The fd protocol expects the number of a file descriptor referencing a
+// listening socket, the listener returned is of the type matching the socket,
+// a *net.TCPListener or a *net.UnixListener.
+// The fdrecv protocol expects the number of a file descriptor referencing a
+// unix domain socket which connections are received from, the listener returned
+// is a *RecvUnixListener.
+//
+// The systemd protocol (which may also be written sd) selects a listener
+// passed by systemd socket activation, the address is either the name of the
+// socket (as set by FileDescriptorName=) or its index in the list of file
+// descriptors passed to the program.
 //
 // The address may contain a path to a file for unix sockets, a pair of an IP
-// address and port, a pair of a network interface name and port, or just port.
+// address and port, a pair of a network interface name and port, a pair of a
+// host name and port, or just port.
+//
+// When no protocol is set, the address is only used as a path to a unix
+// socket if it looks like one, that is if it contains a '/', ends with ".sock",
+// or starts with '@' (abstract socket names, linux only). Host names are
+// resolved and a listener is created for every address they resolve to.
+// Listening on multiple addresses (including all the addresses of a network
+// interface) returns a listener as created by MultiListener.
 //
 // If the port is omitted for network addresses the operating system will pick
-// one automatically.
-func Listen(address string) (lstn net.Listener, err error) {
+// one automatically. The port may also be a range of the form "min-max", in
+// which case the listener is bound to the first port of the range that is free
+// on all addresses, unless the allports option is set.
+//
+// Options may be set on the sockets created by the function with a query
+// string at the end of the address, the supported options are:
+//
+//	reuseport=N		opens N sockets on each address with SO_REUSEPORT set,
+//				the kernel balances the connections across them
+//	backlog=N		length of the queue of pending connections
+//	defer_accept=D		TCP_DEFER_ACCEPT timeout (linux only)
+//	fastopen=N		TCP_FASTOPEN queue length (linux only)
+//	keepalive_idle=D	idle time before sending keep-alive probes
+//	keepalive_interval=D	interval between keep-alive probes
+//	keepalive_count=N	number of unanswered probes before dropping connections
+//	user_timeout=D		TCP_USER_TIMEOUT of accepted connections (linux only)
+//	v6only			sets IPV6_V6ONLY on IPv6 sockets
+//	rcvbuf=N		size of the receive buffer
+//	sndbuf=N		size of the send buffer
+//	freebind		sets IP_FREEBIND (linux only)
+//	allports		binds every port of a range instead of the first free one
+//	watch			follows the changes of addresses of a network interface
+//	cert=F			path to the certificate file of tls listeners
+//	key=F			path to the private key file of tls listeners
+//	handshake_timeout=D	time limit of the TLS handshake (default 10s)
+//	unlink			removes stale unix sockets before creating new ones
+//	mkdir			creates the parent directories of unix sockets
+//	mode=M			octal file mode of unix sockets
+//	owner=U			user name or id owning unix sockets
+//	group=G			group name or id owning unix sockets
+//	keep			doesn't remove unix sockets when the listener is closed
+//
+// Durations (D) are expressed in the format supported by time.ParseDuration.
+// When reuseport is 1 (or has no value) the function opens a single socket,
+// which lets multiple servers or processes listen on the same address. When it
+// is greater than 1 the sockets are merged in a single listener which accepts
+// connections in one loop, see ListenShards to get one listener per socket.
+// See ListenConfig for more details on each option.
+//
+// When the program was started by Restart, the address is first looked up in
+// the names of the listeners inherited from the parent process.
+func Listen(address string) (net.Listener, error) {
+	return (&ListenConfig{}).Listen(address)
+}
+
+// Listen is like the package-level Listen function but applies the options of
+// lc to the sockets it creates. Options set in the query string of address take
+// precedence over the ones set on lc.
+func (lc *ListenConfig) Listen(address string) (net.Listener, error) {
+	lstns, err := lc.ListenShards(address)
+	if err != nil {
+		return nil, err
+	}
+	return mergeListeners(lstns), nil
+}
+
+// ListenShards is like the package-level ListenShards function but applies the
+// options of lc to the sockets it creates.
+func (lc *ListenConfig) ListenShards(address string) (lstns []net.Listener, err error) {
+	var opts ListenConfig
+	var config *tls.Config
+	var name = address
+
+	if address, opts, err = splitListenConfig(address, *lc); err != nil {
+		return
+	}
+
+	if strings.HasPrefix(address, "tls://") {
+		if config, err = opts.tlsConfig(); err != nil {
+			return
+		}
+		address = "tcp://" + address[6:]
+	}
+
+	if lstns, err = opts.listen(name, address); err == nil && config != nil {
+		for i, l := range lstns {
+			lstns[i] = &tlsListener{
+				Listener: l,
+				config:   config,
+				timeout:  opts.handshakeTimeout(),
+			}
+		}
+	}
+
+	return
+}
+
+// ListenShards is like Listen but returns the listeners of every socket that
+// it created instead of merging them in a single compound listener.
+//
+// Listen merges the sockets opened with the reuseport option, which makes
+// connections go through a single accept loop. Programs that need to scale
+// the rate at which they accept connections can use ListenShards and serve
+// each listener with its own accept loop, for example by calling Serve on a
+// Server once per listener in separate goroutines, or by giving each listener
+// to a different Server.
+//
+// Listeners that cannot be split (like the ones following the addresses of a
+// network interface with the watch option) are returned as a single compound
+// listener.
+func ListenShards(address string) ([]net.Listener, error) {
+	return (&ListenConfig{}).ListenShards(address)
+}
+
+func (lc *ListenConfig) listen(name string, address string) (lstns []net.Listener, err error) {
+	var lstn net.Listener
 	var network string
 	var addrs []string
+	var group int
+	var ok bool
+
+	if lstn, ok, err = inherited.take(name); ok || err != nil {
+		if lstn != nil {
+			lstns = []net.Listener{lstn}
+		}
+		return
+	}
 
-	if network, addrs, err = resolveListen(address, "tcp", "unix", []string{
+	if lc.Watch {
+		if lstn, err = lc.listenWatch(address); err == nil {
+			lstns = []net.Listener{lstn}
+		}
+		return
+	}
+
+	if network, addrs, group, err = resolveListen(address, "tcp", "unix", []string{
 		"tcp",
 		"tcp4",
 		"tcp6",
 		"unix",
 		"unixpacket",
 		"fd",
+		"fdrecv",
+		"systemd",
+		"sd",
 	}); err != nil {
 		return
 	}
 
-	if len(addrs) == 1 {
-		return listen(network, addrs[0])
+	if len(addrs) == group || lc.AllPorts {
+		return listenShards(network, addrs, lc)
 	}
 
-	lstns := make([]net.Listener, 0, len(addrs))
-
-	for _, a := range addrs {
-		l, e := listen(network, a)
-		if e != nil {
-			for _, l := range lstns {
-				l.Close()
-			}
+	// The address contained a range of ports, the listener is bound to the
+	// first one that is free on all addresses.
+	for i := 0; i < len(addrs); i += group {
+		if lstns, err = listenShards(network, addrs[i:i+group], lc); !isAddrInUse(err) {
 			return
 		}
-		lstns = append(lstns, l)
 	}
 
-	lstn = MultiListener(lstns...)
+	err = errors.New("no free port to listen on " + address + ": " + err.Error())
 	return
 }
 
-func listen(network string, address string) (lstn net.Listener, err error) {
-	if network == "fd" {
-		var fd int
-		var f *os.File
-		var c net.Conn
+// listenAll creates listeners for every address in addrs, returning a
+// MultiListener if more than one socket was created.
+func listenAll(network string, addrs []string, opts *ListenConfig) (net.Listener, error) {
+	lstns, err := listenShards(network, addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return mergeListeners(lstns), nil
+}
 
-		if fd, err = strconv.Atoi(address); err != nil {
-			err = errors.New("invalid file descriptor in fd://" + address)
-			return
-		} else if fd < 0 {
-			err = errors.New("invalid negative file descriptor in fd://" + address)
-			return
-		}
+// mergeListeners returns a MultiListener made of lstns, or the only listener of
+// the list.
+func mergeListeners(lstns []net.Listener) net.Listener {
+	if len(lstns) == 1 {
+		return lstns[0]
+	}
+	return MultiListener(lstns...)
+}
 
-		f = os.NewFile(uintptr(fd), network)
-		defer f.Close()
+// listenShards creates listeners for every address in addrs, and as many
+// sockets on each address as configured by the reuseport option.
+func listenShards(network string, addrs []string, opts *ListenConfig) (lstns []net.Listener, err error) {
+	n := opts.sockets()
+	lstns = make([]net.Listener, 0, len(addrs)*n)
 
-		if c, err = net.FileConn(f); err != nil {
-			return
+	for _, a := range addrs {
+		for i := 0; i != n; i++ {
+			l, e := listen(network, a, opts)
+			if e != nil {
+				for _, l := range lstns {
+					l.Close()
+				}
+				return nil, e
+			}
+			lstns = append(lstns, l)
+
+			// When the port was chosen by the system the next sockets must be
+			// bound to the same one.
+			if _, port, _ := net.SplitHostPort(a); port == "0" || port == "" {
+				a = l.Addr().String()
+			}
 		}
-		return NewRecvUnixListener(c.(*net.UnixConn)), nil
 	}
-	return net.Listen(network, address)
+
+	return
+}
+
+func listen(network string, address string, opts *ListenConfig) (lstn net.Listener, err error) {
+	switch network {
+	case "systemd":
+		return listenSystemd(address)
+	case "fd":
+		return listenFD(address)
+	case "fdrecv":
+		return listenFDRecv(address)
+	}
+	return opts.listenSocket(network, address)
 }
 
 // ListenPacket is similar to Listen but returns a PacketConn, and works with
-// udp, udp4, udp6, ip, ip4, ip6, unixdgram, or fd protocols.
+// udp, udp4, udp6, ip, ip4, ip6, unixdgram, fd, or systemd protocols.
+//
+// When the address is the name of a network interface, a socket is bound to
+// each address of the interface and the function returns a compound connection
+// as returned by MultiPacketConn. When the address contains a range of ports
+// the connection is bound to the first port that is free.
 func ListenPacket(address string) (conn net.PacketConn, err error) {
 	var network string
 	var addrs []string
+	var group int
 
-	if network, addrs, err = resolveListen(address, "udp", "unixdgram", []string{
+	if network, addrs, group, err = resolveListen(address, "udp", "unixdgram", []string{
 		"udp",
 		"udp4",
 		"udp6",
@@ -97,46 +284,72 @@ func ListenPacket(address string) (conn net.PacketConn, err error) {
 		"ip6",
 		"unixdgram",
 		"fd",
+		"systemd",
+		"sd",
 	}); err != nil {
 		return
 	}
 
+	if network == "systemd" {
+		return listenPacketSystemd(addrs[0])
+	}
+
 	if network == "fd" {
-		var fd int
-		var f *os.File
-		var c net.Conn
+		return listenPacketFD(addrs[0])
+	}
 
-		if fd, err = strconv.Atoi(addrs[0]); err != nil {
-			err = errors.New("invalid file descriptor in fd://" + addrs[0])
-			return
-		} else if fd < 0 {
-			err = errors.New("invalid negative file descriptor in fd://" + addrs[0])
+	// When the address contained a range of ports the connection is bound to
+	// the first one that is free on all addresses.
+	for i := 0; i < len(addrs); i += group {
+		if conn, err = listenPacketAll(network, addrs[i:i+group]); !isAddrInUse(err) {
 			return
 		}
+	}
 
-		f = os.NewFile(uintptr(fd), network)
-		defer f.Close()
+	err = errors.New("no free port to listen on " + address + ": " + err.Error())
+	return
+}
 
-		if c, err = net.FileConn(f); err != nil {
-			return
-		}
-		conn = c.(net.PacketConn)
-		return
+// listenPacketAll creates packet connections for every address in addrs,
+// returning a MultiPacketConn if there was more than one address.
+func listenPacketAll(network string, addrs []string) (conn net.PacketConn, err error) {
+	if len(addrs) == 1 {
+		return net.ListenPacket(network, addrs[0])
 	}
 
-	// TODO: listen on all addresses?
+	conns := make([]net.PacketConn, 0, len(addrs))
+
 	for _, a := range addrs {
-		if conn, err = net.ListenPacket(network, a); err == nil {
-			break
+		c, e := net.ListenPacket(network, a)
+		if e != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			err = e
+			return
 		}
+		conns = append(conns, c)
 	}
 
+	conn = MultiPacketConn(conns...)
 	return
 }
 
-func resolveListen(address string, defaultProtoNetwork string, defaultProtoUnix string, protocols []string) (network string, addrs []string, err error) {
+// isAddrInUse returns true if err was caused by binding a socket to an address
+// that is already in use.
+func isAddrInUse(err error) bool {
+	return syscallError(err) == syscall.EADDRINUSE
+}
+
+// resolveListen parses address and returns the network and the list of
+// addresses to listen on. When the address contains a range of ports, the
+// list contains the addresses for each port in the range, in groups of the
+// given size.
+func resolveListen(address string, defaultProtoNetwork string, defaultProtoUnix string, protocols []string) (network string, addrs []string, group int, err error) {
 	var host string
 	var port string
+	var hosts []string
+	var ports []string
 	var ifi *net.Interface
 
 	if off := strings.Index(address, "://"); off >= 0 {
@@ -153,167 +366,446 @@ func resolveListen(address string, defaultProtoNetwork string, defaultProtoUnix
 		}
 	}
 
-	if network == "fd" {
+	if network == "sd" {
+		network = "systemd"
+	}
+
+	if network == "systemd" {
+		if len(address) == 0 {
+			err = errors.New("expected a socket name or index with systemd:// protocol")
+		}
+		addrs, group = []string{address}, 1
+		return
+	}
+
+	if network == "fd" || network == "fdrecv" {
 		if _, err = strconv.Atoi(address); err != nil {
-			err = errors.New("expected file descriptor number with fd:// protocol but found " + address)
+			err = errors.New("expected file descriptor number with " + network + ":// protocol but found " + address)
 		}
-		addrs = []string{address}
+		addrs, group = []string{address}, 1
 		return
 	}
 
-	if strings.HasPrefix(address, ":") { // :port
-		network = defaultProtoNetwork
-		addrs = []string{address}
+	if strings.HasPrefix(network, "unix") {
+		// The protocol was explicitly set, the address is the path to a unix
+		// domain socket.
+		addrs, group = []string{address}, 1
 		return
 	}
 
-	if host, port, err = net.SplitHostPort(address); err != nil {
-		err = nil
+	if strings.HasPrefix(address, ":") && !isIP(address) {
+		// the address doesn't mention which interface to listen on
+		port = address[1:]
+		hosts = []string{""}
 
-		if strings.HasPrefix(address, ":") {
-			// the address doesn't mention which interface to listen on
-			port = address[1:]
-		} else {
+		if len(network) == 0 {
+			network = defaultProtoNetwork
+		}
+	} else {
+		if host, port, err = net.SplitHostPort(address); err != nil {
 			// the address doesn't mention which port to listen on
-			host = address
+			host, err = address, nil
 		}
-	}
 
-	if IsIP(host) {
-		// The function received a simple IP address to listen on.
-		addrs = append(addrs, address)
+		if len(network) == 0 && isPath(address) {
+			// Neither a protocol nor a pair of host and port was passed and
+			// the address looks like a path to a unix domain socket.
+			network = defaultProtoUnix
+			addrs, group = []string{address}, 1
+			return
+		}
 
 		if len(network) == 0 {
 			network = defaultProtoNetwork
 		}
 
-	} else if ifi, err = net.InterfaceByName(host); err == nil {
-		// The function received the name of a network interface, we have to
-		// lookup the list of all network addresses to listen on.
-		var ifa []net.Addr
+		if isIP(host) {
+			// The function received a simple IP address to listen on.
+			hosts = []string{host}
 
-		if ifa, err = ifi.Addrs(); err != nil {
-			return
-		}
+		} else if ifi, err = net.InterfaceByName(host); err == nil {
+			// The function received the name of a network interface, we have
+			// to lookup the list of all network addresses to listen on.
+			if hosts, err = interfaceHosts(network, ifi); err != nil {
+				return
+			}
+
+			if len(hosts) == 0 {
+				err = errors.New("no " + network + " address found on the " + host + " network interface")
+				return
+			}
+
+		} else {
+			// Neither an IP address nor a network interface name was passed,
+			// the host must be a name that resolves to the list of addresses
+			// to listen on.
+			var ips []net.IPAddr
+
+			if ips, err = net.DefaultResolver.LookupIPAddr(context.Background(), host); err != nil {
+				err = fmt.Errorf("%s is neither an IP address, a network interface, nor a host name that can be resolved (%s), use the unix:// protocol to listen on a unix domain socket", host, err)
+				return
+			}
+
+			for _, ip := range ips {
+				if !matchFamily(network, ip.IP) {
+					continue
+				}
+
+				s := ip.IP.String()
+				if len(ip.Zone) != 0 {
+					s += "%" + ip.Zone
+				}
+
+				hosts = append(hosts, s)
+			}
 
-		for _, a := range ifa {
-			s := a.String()
-			if len(port) != 0 {
-				s = net.JoinHostPort(s, port)
+			if len(hosts) == 0 {
+				err = errors.New("no " + network + " address found for " + host)
+				return
 			}
-			addrs = append(addrs, s)
 		}
+	}
 
-		if len(network) == 0 {
-			network = defaultProtoNetwork
+	if ports, err = splitPortRange(port); err != nil {
+		return
+	}
+
+	addrs = make([]string, 0, len(hosts)*len(ports))
+	group = len(hosts)
+
+	for _, p := range ports {
+		for _, h := range hosts {
+			addrs = append(addrs, net.JoinHostPort(h, p))
 		}
+	}
 
-	} else {
-		err = nil
-		// Neither an IP address nor a network interface name was passed, we
-		// assume this address is probably the path to a unix domain socket.
-		addrs = append(addrs, address)
+	return
+}
 
-		if len(network) == 0 {
-			network = defaultProtoUnix
+// splitPortRange returns the list of ports in a range of the form "min-max",
+// or a list containing only port if it isn't a range.
+func splitPortRange(port string) ([]string, error) {
+	i := strings.IndexByte(port, '-')
+	if i < 0 {
+		return []string{port}, nil
+	}
+
+	min, err1 := strconv.ParseUint(port[:i], 10, 16)
+	max, err2 := strconv.ParseUint(port[i+1:], 10, 16)
+
+	if err1 != nil || err2 != nil || min == 0 || min > max {
+		return nil, errors.New("invalid port range: " + port)
+	}
+
+	ports := make([]string, 0, max-min+1)
+
+	for p := min; p <= max; p++ {
+		ports = append(ports, strconv.FormatUint(p, 10))
+	}
+
+	return ports, nil
+}
+
+// interfaceHosts returns the list of addresses of ifi that can be used on
+// network.
+func interfaceHosts(network string, ifi *net.Interface) (hosts []string, err error) {
+	var ifa []net.Addr
+
+	if ifa, err = ifi.Addrs(); err != nil {
+		return
+	}
+
+	for _, a := range ifa {
+		var ip net.IP
+
+		switch x := a.(type) {
+		case *net.IPNet:
+			ip = x.IP
+		case *net.IPAddr:
+			ip = x.IP
+		default:
+			continue
+		}
+
+		if !matchFamily(network, ip) {
+			continue
 		}
+
+		s := ip.String()
+		if ip.IsLinkLocalUnicast() && ip.To4() == nil {
+			s += "%" + ifi.Name
+		}
+
+		hosts = append(hosts, s)
 	}
 
 	return
 }
 
+// isPath returns true if s looks like the path to a unix domain socket.
+func isPath(s string) bool {
+	return strings.HasPrefix(s, "@") || strings.ContainsRune(s, '/') || strings.HasSuffix(s, ".sock")
+}
+
+// isIP is like IsIP but also accepts IPv6 addresses with a zone.
+func isIP(s string) bool {
+	if i := strings.LastIndexByte(s, '%'); i >= 0 && IsIPv6(s[:i]) {
+		return true
+	}
+	return IsIP(s)
+}
+
+// matchFamily returns true if ip can be used on network, which is restricted to
+// one address family when it ends with 4 or 6.
+func matchFamily(network string, ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
 // MultiListener returns a compound listener made of the given list of
 // listeners.
+//
+// The returned value is a *DynamicListener, which means that listeners can be
+// added or removed after it was created.
 func MultiListener(lstn ...net.Listener) net.Listener {
-	c := make(chan net.Conn)
-	e := make(chan error)
-	d := make(chan struct{})
-	x := make(chan struct{})
-	m := &multiListener{
-		l: append(make([]net.Listener, 0, len(lstn)), lstn...),
-		c: c,
-		e: e,
-		d: d,
-		x: x,
-	}
-
-	for _, l := range m.l {
-		go func(l net.Listener, c chan<- net.Conn, e chan<- error, d chan<- struct{}) {
-			defer func() { d <- struct{}{} }()
-			for {
-				if conn, err := l.Accept(); err == nil {
-					c <- conn
-				} else {
-					e <- err
-
-					if !IsTemporary(err) {
-						break
-					}
-				}
-			}
-		}(l, c, e, d)
+	return NewDynamicListener(lstn...)
+}
+
+// NewDynamicListener returns a compound listener made of the given list of
+// listeners, which can be modified by calling the Add and Remove methods.
+func NewDynamicListener(lstn ...net.Listener) *DynamicListener {
+	d := &DynamicListener{
+		c: make(chan net.Conn),
+		e: make(chan error),
+		x: make(chan struct{}),
+	}
+
+	for _, l := range lstn {
+		d.Add(l)
 	}
 
-	return m
+	return d
 }
 
-type multiListener struct {
-	l []net.Listener  // the list of listeners
-	c <-chan net.Conn // connections from Accept are published on this channel
-	e <-chan error    // errors from Accept are published on this channel
-	d <-chan struct{} // each goroutine publishes to this channel when they exit
-	x chan struct{}   // closed when the listener is closed
+// DynamicListener is a compound listener which accepts connections from a set
+// of listeners that may change while the listener is in use, for example to
+// start listening on new addresses without restarting a Server.
+//
+// Errors returned by the listeners are reported by Accept as *ListenerError
+// values, which carry the address of the listener that failed. When a listener
+// returns a permanent error it is removed from the set but the other listeners
+// keep running. Accept blocks while the set is empty, until a listener is added
+// or the compound listener is closed. When the set became empty because the
+// last listener failed, Accept returns its error (which isn't temporary) until
+// a listener is added.
+type DynamicListener struct {
+	mutex  sync.Mutex
+	l      []net.Listener // the list of listeners
+	err    error          // set when the last listener failed
+	closed bool
+
+	c chan net.Conn  // connections from Accept are published on this channel
+	e chan error     // errors from Accept are published on this channel
+	x chan struct{}  // closed when the listener is closed
+	w sync.WaitGroup // tracks the goroutines accepting connections
 
 	// Used by Close to allow multiple goroutines to call the method as well as
 	// allowing the method to be called multiple times.
 	once sync.Once
 }
 
-func (m *multiListener) Accept() (conn net.Conn, err error) {
+// Add adds lstn to the set of listeners that d accepts connections from.
+//
+// The method returns an error if d was already closed, in which case lstn is
+// left untouched.
+func (d *DynamicListener) Add(lstn net.Listener) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return io.ErrClosedPipe
+	}
+
+	d.l = append(d.l, lstn)
+	d.err = nil
+	d.w.Add(1)
+	go d.run(lstn)
+	return nil
+}
+
+// Remove closes the listener bound to addr and removes it from the set of
+// listeners that d accepts connections from.
+func (d *DynamicListener) Remove(addr net.Addr) error {
+	lstn := d.remove(func(l net.Listener) bool {
+		a := l.Addr()
+		return a.Network() == addr.Network() && a.String() == addr.String()
+	})
+
+	if lstn == nil {
+		return errors.New("no listener bound to " + addr.Network() + "://" + addr.String())
+	}
+
+	return lstn.Close()
+}
+
+// Listeners returns the list of listeners that d accepts connections from.
+func (d *DynamicListener) Listeners() []net.Listener {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]net.Listener{}, d.l...)
+}
+
+// Accept returns the next connection accepted by any of the listeners.
+func (d *DynamicListener) Accept() (conn net.Conn, err error) {
+	d.mutex.Lock()
+	err = d.err
+	d.mutex.Unlock()
+
+	if err != nil {
+		return
+	}
+
 	select {
-	case conn = <-m.c:
-	case err = <-m.e:
-	case <-m.x:
+	case conn = <-d.c:
+	case err = <-d.e:
+	case <-d.x:
 		err = io.ErrClosedPipe
 	}
 	return
 }
 
-func (m *multiListener) Close() (err error) {
-	m.once.Do(func() {
+// Close closes all the listeners.
+func (d *DynamicListener) Close() (err error) {
+	d.once.Do(func() {
 		var errs []string
 
-		for _, l := range m.l {
+		d.mutex.Lock()
+		lstn := d.l
+		d.l = nil
+		d.closed = true
+		d.mutex.Unlock()
+
+		close(d.x)
+
+		for _, l := range lstn {
 			if e := l.Close(); e != nil {
 				errs = append(errs, e.Error())
 			}
 		}
 
-		for i, n := 0, len(m.l); i != n; {
-			select {
-			case conn := <-m.c:
-				conn.Close()
-			case <-m.e:
-			case <-m.d:
-				i++
-			}
-		}
+		d.w.Wait()
 
 		if errs != nil {
 			err = errors.New(strings.Join(errs, "; "))
 		}
-
-		close(m.x)
 	})
 	return
 }
 
-func (m *multiListener) Addr() net.Addr {
-	a := make(MultiAddr, len(m.l))
+// Addr returns a MultiAddr made of the addresses of the listeners that d
+// currently accepts connections from.
+func (d *DynamicListener) Addr() net.Addr {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 
-	for i, l := range m.l {
+	a := make(MultiAddr, len(d.l))
+
+	for i, l := range d.l {
 		a[i] = l.Addr()
 	}
 
 	return a
 }
+
+func (d *DynamicListener) run(lstn net.Listener) {
+	defer d.w.Done()
+
+	for {
+		conn, err := lstn.Accept()
+
+		if err == nil {
+			select {
+			case d.c <- conn:
+			case <-d.x:
+				conn.Close()
+				return
+			}
+			continue
+		}
+
+		temporary := IsTemporary(err)
+		lerr := &ListenerError{Addr: lstn.Addr(), Err: err}
+
+		if !temporary {
+			// The listener cannot be used anymore, it is removed from the set
+			// and the error is reported unless the listener was removed or
+			// closed by a call to Remove or Close.
+			if d.remove(func(l net.Listener) bool { return l == lstn }) == nil {
+				return
+			}
+
+			d.mutex.Lock()
+			if len(d.l) == 0 {
+				lerr.last, d.err = true, lerr
+			}
+			d.mutex.Unlock()
+		}
+
+		select {
+		case d.e <- lerr:
+		case <-d.x:
+			return
+		}
+
+		if !temporary {
+			return
+		}
+	}
+}
+
+func (d *DynamicListener) remove(match func(net.Listener) bool) net.Listener {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, l := range d.l {
+		if match(l) {
+			copy(d.l[i:], d.l[i+1:])
+			d.l[len(d.l)-1] = nil
+			d.l = d.l[:len(d.l)-1]
+			return l
+		}
+	}
+
+	return nil
+}
+
+// ListenerError is the type of errors returned by the Accept method of
+// compound listeners, it carries the address of the listener that failed.
+type ListenerError struct {
+	Addr net.Addr
+	Err  error
+
+	last bool // the error removed the last listener of the set
+}
+
+// Error satisfies the error interface.
+func (e *ListenerError) Error() string {
+	return "accept " + e.Addr.Network() + "://" + e.Addr.String() + ": " + e.Err.Error()
+}
+
+// Timeout returns true if the error was caused by a timeout.
+func (e *ListenerError) Timeout() bool {
+	return IsTimeout(e.Err)
+}
+
+// Temporary returns true if the error of the listener was temporary, or if
+// the compound listener still has other listeners to accept connections from.
+func (e *ListenerError) Temporary() bool {
+	return IsTemporary(e.Err) || !e.last
+}
@@ -0,0 +1,339 @@
+package netx
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestResolveListen(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addrs   []string
+		group   int
+	}{
+		{
+			address: ":4242",
+			network: "tcp",
+			addrs:   []string{":4242"},
+		},
+		{
+			address: "tcp4://:4242",
+			network: "tcp4",
+			addrs:   []string{":4242"},
+		},
+		{
+			address: "127.0.0.1:4242",
+			network: "tcp",
+			addrs:   []string{"127.0.0.1:4242"},
+		},
+		{
+			address: "::1",
+			network: "tcp",
+			addrs:   []string{"[::1]:"},
+		},
+		{
+			address: "/tmp/netx.sock",
+			network: "unix",
+			addrs:   []string{"/tmp/netx.sock"},
+		},
+		{
+			address: "netx.sock",
+			network: "unix",
+			addrs:   []string{"netx.sock"},
+		},
+		{
+			address: "@netx",
+			network: "unix",
+			addrs:   []string{"@netx"},
+		},
+		{
+			address: "unix://netx",
+			network: "unix",
+			addrs:   []string{"netx"},
+		},
+		{
+			address: "tcp4://localhost:4242",
+			network: "tcp4",
+			addrs:   []string{"127.0.0.1:4242"},
+		},
+		{
+			address: "tcp://127.0.0.1:9000-9002",
+			network: "tcp",
+			addrs:   []string{"127.0.0.1:9000", "127.0.0.1:9001", "127.0.0.1:9002"},
+			group:   1,
+		},
+		{
+			address: ":9000-9001",
+			network: "tcp",
+			addrs:   []string{":9000", ":9001"},
+			group:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			network, addrs, group, err := resolveListen(test.address, "tcp", "unix", []string{"tcp", "tcp4", "tcp6", "unix"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.group == 0 {
+				test.group = len(test.addrs)
+			}
+
+			if group != test.group {
+				t.Error("bad group size:", group)
+			}
+
+			if network != test.network {
+				t.Error("bad network:", network)
+			}
+
+			if len(addrs) != len(test.addrs) {
+				t.Fatal("bad addresses:", addrs)
+			}
+
+			for i := range addrs {
+				if addrs[i] != test.addrs[i] {
+					t.Error("bad addresses:", addrs)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveListenError(t *testing.T) {
+	for _, address := range []string{
+		"http://localhost:80",
+		"netx-host-does-not-exist.invalid:4242",
+		"127.0.0.1:9100-9000",
+		"127.0.0.1:0-10",
+		"127.0.0.1:9000-",
+		"127.0.0.1:1-65536",
+	} {
+		t.Run(address, func(t *testing.T) {
+			if _, _, _, err := resolveListen(address, "tcp", "unix", []string{"tcp"}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestListenHostname(t *testing.T) {
+	lstn, err := Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	switch a := lstn.Addr().(type) {
+	case MultiAddr:
+		for _, x := range a {
+			if x.Network() != "tcp" {
+				t.Error("bad listener address:", a)
+			}
+		}
+	default:
+		if a.Network() != "tcp" {
+			t.Error("bad listener address:", a)
+		}
+	}
+}
+
+func TestListenPortRange(t *testing.T) {
+	// Find a range of ports by letting the system pick the first one, there
+	// is a small chance that the next ports are used by other programs in
+	// which case the test is skipped.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	if port > 65533 {
+		t.Skip("no room for a range of ports after", port)
+	}
+	ports := strconv.Itoa(port) + "-" + strconv.Itoa(port+2)
+
+	t.Run("first", func(t *testing.T) {
+		lstn, err := Listen("tcp://127.0.0.1:" + ports)
+		if err != nil {
+			t.Skip(err)
+		}
+		defer lstn.Close()
+
+		// The first port is taken by l, the listener gets one of the next
+		// ports in the range.
+		if p := lstn.Addr().(*net.TCPAddr).Port; p <= port || p > port+2 {
+			t.Error("bad port:", p)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		l.Close()
+
+		lstn, err := Listen("tcp://127.0.0.1:" + ports + "?allports")
+		if err != nil {
+			t.Skip(err)
+		}
+		defer lstn.Close()
+
+		addrs, ok := lstn.Addr().(MultiAddr)
+		if !ok || len(addrs) != 3 {
+			t.Fatal("bad listener address:", lstn.Addr())
+		}
+
+		for i, a := range addrs {
+			if p := a.(*net.TCPAddr).Port; p != port+i {
+				t.Error("bad port:", p)
+			}
+		}
+	})
+}
+
+func TestDynamicListener(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lstn := NewDynamicListener(l1)
+	defer lstn.Close()
+
+	if err := lstn.Add(l2); err != nil {
+		t.Fatal(err)
+	}
+
+	if a := lstn.Addr().(MultiAddr); len(a) != 2 {
+		t.Fatal("bad listener address:", a)
+	}
+
+	accept := func(addr net.Addr) {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		accepted, err := lstn.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+
+		if accepted.LocalAddr().String() != addr.String() {
+			t.Error("bad local address:", accepted.LocalAddr())
+		}
+	}
+
+	accept(l2.Addr())
+
+	if err := lstn.Remove(l1.Addr()); err != nil {
+		t.Error(err)
+	}
+
+	if err := lstn.Remove(l1.Addr()); err == nil {
+		t.Error("expected an error when removing a listener twice")
+	}
+
+	if a := lstn.Addr().(MultiAddr); len(a) != 1 || a[0] != l2.Addr() {
+		t.Error("bad listener address:", a)
+	}
+
+	if conn, err := net.Dial("tcp", l1.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("the removed listener is still accepting connections")
+	}
+
+	accept(l2.Addr())
+}
+
+func TestDynamicListenerError(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("failure")
+	l2 := &failingListener{addr: &NetAddr{Net: "test", Addr: "fail"}, err: failure}
+
+	lstn := NewDynamicListener(l1, l2)
+
+	_, err = lstn.Accept()
+
+	switch e := err.(type) {
+	case *ListenerError:
+		if e.Addr != l2.addr || e.Err != failure {
+			t.Error("bad error:", e)
+		}
+		if !e.Temporary() {
+			t.Error("the error must be temporary since other listeners are still running")
+		}
+	default:
+		t.Fatal("bad error:", err)
+	}
+
+	if a := lstn.Addr().(MultiAddr); len(a) != 1 || a[0] != l1.Addr() {
+		t.Error("bad listener address:", a)
+	}
+
+	conn, err := net.Dial("tcp", l1.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	accepted, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// Once the last listener failed the compound listener cannot accept
+	// connections anymore, Accept must report a permanent error instead of
+	// blocking forever.
+	l1.Close()
+
+	for i := 0; i != 2; i++ {
+		_, err = lstn.Accept()
+
+		if e, ok := err.(*ListenerError); !ok || e.Addr != l1.Addr() {
+			t.Fatal("bad error:", err)
+		}
+
+		if IsTemporary(err) {
+			t.Error("the error must not be temporary since no listeners are left")
+		}
+	}
+
+	if err := lstn.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := lstn.Accept(); err == nil {
+		t.Error("expected an error after closing the listener")
+	}
+
+	if err := lstn.Add(l1); err == nil {
+		t.Error("expected an error when adding a listener after closing")
+	}
+}
+
+type failingListener struct {
+	addr net.Addr
+	err  error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) { return nil, l.err }
+func (l *failingListener) Close() error              { return nil }
+func (l *failingListener) Addr() net.Addr            { return l.addr }
@@ -0,0 +1,93 @@
+package netx
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// A Logger is the interface used by servers to report events that occur while
+// serving connections.
+//
+// Events carry structured information which makes it possible for programs to
+// forward them to log pipelines without having to parse free-form messages.
+type Logger interface {
+	Log(Event)
+}
+
+// The LoggerFunc type allows simple functions to be used as loggers.
+type LoggerFunc func(Event)
+
+// Log calls f.
+func (f LoggerFunc) Log(e Event) {
+	f(e)
+}
+
+// NewLogger returns a Logger which outputs the events it receives to logger,
+// formatted with the Event.String method. If logger is nil the standard logger
+// of the log package is used.
+func NewLogger(logger *log.Logger) Logger {
+	return LoggerFunc(func(e Event) {
+		logf(logger)("%s", e)
+	})
+}
+
+// EventType is an enumeration of the types of events reported to loggers.
+type EventType string
+
+const (
+	// EventAcceptError is reported when accepting a connection failed with a
+	// temporary error and the server is going to retry.
+	EventAcceptError EventType = "accept-error"
+
+	// EventPanic is reported when a handler panicked while serving a
+	// connection.
+	EventPanic EventType = "panic"
+)
+
+// An Event carries the information reported to a Logger.
+type Event struct {
+	Type       EventType     // type of the event
+	LocalAddr  net.Addr      // local address of the connection or listener
+	RemoteAddr net.Addr      // remote address of the connection, may be nil
+	Error      error         // the error that triggered the event, may be nil
+	ErrorKind  string        // "timeout", "temporary", or "permanent"
+	Panic      interface{}   // value recovered from a panic, set on EventPanic
+	Attempt    int           // attempt number for operations that get retried
+	Backoff    time.Duration // time to wait before retrying
+	Stack      []byte        // stack trace of the goroutine that triggered the event
+}
+
+// String returns a human-readable representation of e.
+func (e Event) String() string {
+	switch e.Type {
+	case EventAcceptError:
+		return fmt.Sprintf("Accept error: %v; retrying in %v", e.Error, e.Backoff)
+	case EventPanic:
+		return fmt.Sprintf("panic serving %s->%s: %v\n%s", e.LocalAddr, e.RemoteAddr, e.Panic, string(e.Stack))
+	default:
+		return fmt.Sprintf("%s: %v", e.Type, e.Error)
+	}
+}
+
+// errorKind returns a short description of the kind of error that err is.
+func errorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case IsTimeout(err):
+		return "timeout"
+	case IsTemporary(err):
+		return "temporary"
+	default:
+		return "permanent"
+	}
+}
+
+func logf(logger *log.Logger) func(string, ...interface{}) {
+	if logger == nil {
+		return log.Printf
+	}
+	return logger.Printf
+}
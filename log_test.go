@@ -0,0 +1,85 @@
+package netx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(log.New(buf, "", 0))
+
+	logger.Log(Event{
+		Type:    EventAcceptError,
+		Error:   Timeout("too many open files"),
+		Backoff: 10 * time.Millisecond,
+	})
+
+	if s := buf.String(); s != "Accept error: too many open files; retrying in 10ms\n" {
+		t.Errorf("bad log output: %q", s)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{nil, ""},
+		{testError{timeout: true}, "timeout"},
+		{testError{temporary: true}, "temporary"},
+		{errors.New(""), "permanent"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			if kind := errorKind(test.err); kind != test.kind {
+				t.Error("bad error kind:", kind)
+			}
+		})
+	}
+}
+
+func TestServerLoggerPanic(t *testing.T) {
+	events := make(chan Event, 1)
+	addr, close := listenAndServeWith(&Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			panic(errors.New("oops"))
+		}),
+		Logger: LoggerFunc(func(e Event) { events <- e }),
+	})
+	defer close()
+
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case e := <-events:
+		if e.Type != EventPanic {
+			t.Error("bad event type:", e.Type)
+		}
+		if e.Error == nil || e.Error.Error() != "oops" {
+			t.Error("bad event error:", e.Error)
+		}
+		if e.ErrorKind != "permanent" {
+			t.Error("bad event error kind:", e.ErrorKind)
+		}
+		if e.RemoteAddr.String() != conn.LocalAddr().String() {
+			t.Error("bad event remote address:", e.RemoteAddr)
+		}
+		if !strings.Contains(string(e.Stack), "TestServerLoggerPanic") {
+			t.Errorf("bad event stack:\n%s", e.Stack)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("no panic event reported")
+	}
+}
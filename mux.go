@@ -0,0 +1,259 @@
+package netx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MatchResult is the type of values returned by matchers.
+type MatchResult int
+
+const (
+	// NeedMore is returned by matchers that need more bytes to decide whether
+	// the connection speaks their protocol.
+	NeedMore MatchResult = iota
+
+	// Match is returned by matchers when the connection speaks their protocol.
+	Match
+
+	// NoMatch is returned by matchers when the connection does not speak their
+	// protocol.
+	NoMatch
+)
+
+// A Matcher identifies a protocol from the first bytes received on a
+// connection.
+//
+// The Match method is called by a Mux with all the bytes received so far, it
+// must not retain or modify the slice.
+type Matcher interface {
+	Match(prefix []byte) MatchResult
+}
+
+// MatcherFunc makes it possible for simple function types to be used as
+// matchers.
+type MatcherFunc func([]byte) MatchResult
+
+// Match calls f.
+func (f MatcherFunc) Match(prefix []byte) MatchResult {
+	return f(prefix)
+}
+
+// MatchPrefix returns a matcher which matches connections starting with one of
+// the given prefixes.
+func MatchPrefix(prefixes ...string) Matcher {
+	list := make([][]byte, len(prefixes))
+
+	for i, p := range prefixes {
+		list[i] = []byte(p)
+	}
+
+	return MatcherFunc(func(b []byte) MatchResult {
+		return matchPrefix(b, list...)
+	})
+}
+
+var (
+	// MatchAny is a matcher which matches all connections, registering it last
+	// on a Mux defines the handler for connections that no other matchers
+	// recognized.
+	MatchAny Matcher = MatcherFunc(matchAny)
+
+	// MatchTLS is a matcher for connections which start with a TLS handshake
+	// record, see TLSRouter to route those connections based on the server
+	// name.
+	MatchTLS Matcher = MatcherFunc(matchTLS)
+
+	// MatchHTTP is a matcher for connections which start with an HTTP/1.x
+	// request line using one of the standard methods, or with the HTTP/2
+	// connection preface.
+	MatchHTTP Matcher = MatchPrefix(
+		"GET ",
+		"HEAD ",
+		"POST ",
+		"PUT ",
+		"DELETE ",
+		"CONNECT ",
+		"OPTIONS ",
+		"TRACE ",
+		"PATCH ",
+		"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+	)
+
+	// MatchProxyProtocol is a matcher for connections which start with the
+	// header of version 1 or 2 of the proxy protocol, see ProxyProtocol.
+	MatchProxyProtocol Matcher = MatchPrefix(
+		string(proxy[:])+" ",
+		string(signature[:]),
+	)
+
+	// MatchSSH is a matcher for connections which start with the
+	// identification string of the SSH protocol.
+	MatchSSH Matcher = MatchPrefix("SSH-")
+)
+
+func matchAny(b []byte) MatchResult {
+	return Match
+}
+
+func matchTLS(b []byte) MatchResult {
+	// Handshake record with a major version of 3 and a minor version from 0
+	// (SSL 3.0) to 4 (TLS 1.3).
+	r := matchPrefix(b, []byte{tlsRecordTypeHandshake, 3})
+
+	if r == Match {
+		if len(b) < 3 {
+			return NeedMore
+		}
+		if b[2] > 4 {
+			return NoMatch
+		}
+	}
+
+	return r
+}
+
+func matchPrefix(b []byte, prefixes ...[]byte) MatchResult {
+	r := NoMatch
+
+	for _, p := range prefixes {
+		switch {
+		case bytes.HasPrefix(b, p):
+			return Match
+		case bytes.HasPrefix(p, b):
+			r = NeedMore
+		}
+	}
+
+	return r
+}
+
+// Mux is a connection handler which identifies the protocol spoken by the
+// clients, and dispatches connections to the handler registered for it. This
+// makes it possible to serve multiple protocols on a single port.
+//
+// The mux reads the first bytes of each connection, and passes them to the
+// matchers in the order they were registered, the connection is dispatched to
+// the handler of the first matcher that matches. A matcher which needs more
+// bytes prevents matchers registered after it from being selected until it
+// made a decision, or until the mux reads the maximum number of bytes or times
+// out, in which case matchers needing more bytes are considered to not match.
+//
+// The bytes read by the mux are replayed to the handler, which sees the
+// connection as if nothing had been read from it.
+//
+// The zero-value is a mux with no matchers, which is ready to use.
+type Mux struct {
+	// Timeout is the maximum amount of time that the mux waits for the client
+	// to send enough bytes to identify the protocol, it defaults to 10
+	// seconds.
+	Timeout time.Duration
+
+	// MaxPrefixSize is the maximum number of bytes that the mux reads to
+	// identify the protocol, it defaults to 4096.
+	MaxPrefixSize int
+
+	mutex  sync.RWMutex
+	routes []muxRoute
+}
+
+type muxRoute struct {
+	matcher Matcher
+	handler Handler
+}
+
+// Handle registers handler for connections recognized by matcher.
+func (m *Mux) Handle(matcher Matcher, handler Handler) {
+	if matcher == nil {
+		panic("netx.Mux: nil matcher")
+	}
+
+	if handler == nil {
+		panic("netx.Mux: nil handler")
+	}
+
+	m.mutex.Lock()
+	m.routes = append(m.routes, muxRoute{matcher: matcher, handler: handler})
+	m.mutex.Unlock()
+}
+
+// HandleFunc registers handler for connections recognized by matcher.
+func (m *Mux) HandleFunc(matcher Matcher, handler func(context.Context, net.Conn)) {
+	m.Handle(matcher, HandlerFunc(handler))
+}
+
+// ServeConn satisfies the Handler interface.
+//
+// The method panics to report errors.
+func (m *Mux) ServeConn(ctx context.Context, conn net.Conn) {
+	timeout := m.Timeout
+	maxSize := m.MaxPrefixSize
+
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	if maxSize == 0 {
+		maxSize = 4096
+	}
+
+	m.mutex.RLock()
+	routes := m.routes
+	m.mutex.RUnlock()
+
+	buf := make([]byte, 0, maxSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		// Once no more bytes can be read the matchers that are still waiting
+		// are considered to not match.
+		final := len(buf) == cap(buf)
+
+		if err != nil {
+			if len(buf) == 0 && err == io.EOF {
+				conn.Close()
+				return
+			}
+			if err != io.EOF && !IsTimeout(err) {
+				fatal(conn, err)
+			}
+			final = true
+		}
+
+		if handler, ok := matchRoute(routes, buf, final); ok {
+			conn.SetReadDeadline(time.Time{})
+
+			if handler == nil {
+				fatal(conn, fmt.Errorf("no protocol matched the first %d bytes received from %s", len(buf), conn.RemoteAddr()))
+			}
+
+			handler.ServeConn(ctx, &replayConn{Conn: conn, buf: buf})
+			return
+		}
+	}
+}
+
+// matchRoute returns the handler of the first route that matches b, or false if
+// a decision cannot be made yet. If all matchers reject b, the returned handler
+// is nil.
+func matchRoute(routes []muxRoute, b []byte, final bool) (Handler, bool) {
+	for _, r := range routes {
+		switch r.matcher.Match(b) {
+		case Match:
+			return r.handler, true
+		case NeedMore:
+			if !final {
+				return nil, false
+			}
+		}
+	}
+	return nil, true
+}
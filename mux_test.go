@@ -0,0 +1,196 @@
+package netx
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher Matcher
+		prefix  string
+		result  MatchResult
+	}{
+		{"prefix", MatchPrefix("hello", "world"), "hello world", Match},
+		{"prefix", MatchPrefix("hello", "world"), "wor", NeedMore},
+		{"prefix", MatchPrefix("hello", "world"), "", NeedMore},
+		{"prefix", MatchPrefix("hello", "world"), "help", NoMatch},
+
+		{"tls", MatchTLS, "\x16\x03\x01\x02\x00", Match},
+		{"tls", MatchTLS, "\x16\x03", NeedMore},
+		{"tls", MatchTLS, "\x16\x03\x05", NoMatch},
+		{"tls", MatchTLS, "\x17\x03\x01", NoMatch},
+
+		{"http", MatchHTTP, "GET / HTTP/1.1\r\n", Match},
+		{"http", MatchHTTP, "OPTIONS * HTTP/1.1\r\n", Match},
+		{"http", MatchHTTP, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", Match},
+		{"http", MatchHTTP, "PRI * HTTP/2.0\r\n", NeedMore},
+		{"http", MatchHTTP, "DEL", NeedMore},
+		{"http", MatchHTTP, "GETS", NoMatch},
+		{"http", MatchHTTP, "SSH-2.0-OpenSSH\r\n", NoMatch},
+
+		{"proxy", MatchProxyProtocol, "PROXY TCP4 127.0.0.1 127.0.0.1 1 2\r\n", Match},
+		{"proxy", MatchProxyProtocol, string(signature[:]) + "\x21", Match},
+		{"proxy", MatchProxyProtocol, "\r\n\r\n", NeedMore},
+		{"proxy", MatchProxyProtocol, "PRI", NoMatch},
+
+		{"ssh", MatchSSH, "SSH-2.0-OpenSSH\r\n", Match},
+		{"ssh", MatchSSH, "SS", NeedMore},
+
+		{"any", MatchAny, "", Match},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if r := test.matcher.Match([]byte(test.prefix)); r != test.result {
+				t.Errorf("%q: bad result: %d != %d", test.prefix, test.result, r)
+			}
+		})
+	}
+}
+
+// named returns a handler which writes name to the connections it receives,
+// followed by the bytes it reads until EOF.
+func named(name string) Handler {
+	return HandlerFunc(func(ctx context.Context, conn net.Conn) {
+		defer conn.Close()
+		io.WriteString(conn, name+":")
+		b, _ := ioutil.ReadAll(conn)
+		conn.Write(b)
+	})
+}
+
+func TestMux(t *testing.T) {
+	mux := &Mux{Timeout: 100 * time.Millisecond}
+	mux.Handle(MatchHTTP, named("http"))
+	mux.Handle(MatchSSH, named("ssh"))
+	mux.Handle(MatchPrefix("SSH-1."), named("unreachable"))
+	mux.Handle(MatchPrefix("hello"), named("hello"))
+	mux.Handle(MatchAny, named("any"))
+
+	addr, close := listenAndServe(mux)
+	defer close()
+
+	tests := []struct {
+		chunks []string
+		output string
+	}{
+		{[]string{"GET / HTTP/1.1\r\n\r\n"}, "http:GET / HTTP/1.1\r\n\r\n"},
+		{[]string{"G", "E", "T", " /"}, "http:GET /"},
+		{[]string{"SSH-1.5-test\r\n"}, "ssh:SSH-1.5-test\r\n"},
+		{[]string{"hel", "lo world"}, "hello:hello world"},
+		{[]string{"he"}, "any:he"}, // EOF while the matcher needs more bytes
+		{[]string{"bonjour"}, "any:bonjour"},
+		{nil, "any:"}, // timeout before the client sends anything
+	}
+
+	for _, test := range tests {
+		t.Run(test.output, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			for _, c := range test.chunks {
+				io.WriteString(conn, c)
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if test.chunks == nil {
+				time.Sleep(200 * time.Millisecond)
+			}
+
+			conn.(*net.TCPConn).CloseWrite()
+
+			b, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s := string(b); s != test.output {
+				t.Errorf("bad output: %q != %q", test.output, s)
+			}
+		})
+	}
+}
+
+func TestMuxMaxPrefixSize(t *testing.T) {
+	mux := &Mux{MaxPrefixSize: 4}
+	mux.Handle(MatchPrefix("hello"), named("hello"))
+	mux.Handle(MatchAny, named("any"))
+
+	addr, close := listenAndServe(mux)
+	defer close()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The hello matcher cannot decide within the limit, the client does not
+	// close the connection so the decision must be made without waiting.
+	io.WriteString(conn, "hell")
+
+	b := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b); s != "any:" {
+		t.Error("bad output:", s)
+	}
+
+	conn.(*net.TCPConn).CloseWrite()
+
+	if b, _ = ioutil.ReadAll(conn); string(b) != "hell" {
+		t.Error("bad output:", string(b))
+	}
+}
+
+func TestMuxProxyProtocolTLS(t *testing.T) {
+	mux := &Mux{}
+	mux.Handle(MatchTLS, HandlerFunc(func(ctx context.Context, conn net.Conn) {
+		defer conn.Close()
+
+		if hello, _, err := readTLSClientHello(conn); err != nil {
+			t.Error(err)
+		} else {
+			io.WriteString(conn, conn.RemoteAddr().String()+" "+hello.ServerName)
+		}
+	}))
+
+	mux.Handle(MatchProxyProtocol, &ProxyProtocol{Handler: mux})
+
+	addr, close := listenAndServe(mux)
+	defer close()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\n")
+	conn.Write(clientHello(t, &tls.Config{ServerName: "example.com"}))
+
+	b := make([]byte, 26)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b); s != "192.0.2.1:1234 example.com" {
+		t.Error("bad output:", s)
+	}
+}
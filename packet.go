@@ -0,0 +1,276 @@
+package netx
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiPacketConn returns a compound packet connection made of the given list
+// of connections.
+//
+// Packets read from any of the connections are returned by ReadFrom, WriteTo
+// sends packets through the connection which local address is on the same
+// subnet as the destination, or falls back to the first connection of the same
+// address family.
+func MultiPacketConn(conns ...net.PacketConn) net.PacketConn {
+	p := make(chan *packet)
+	d := make(chan struct{})
+	x := make(chan struct{})
+	m := &multiPacketConn{
+		c: append(make([]net.PacketConn, 0, len(conns)), conns...),
+		r: make([]packetRoute, len(conns)),
+		p: p,
+		d: d,
+		x: x,
+		u: make(chan struct{}),
+	}
+
+	for i, c := range m.c {
+		m.r[i] = makePacketRoute(c.LocalAddr())
+	}
+
+	for _, c := range m.c {
+		go func(c net.PacketConn, p chan<- *packet, d chan<- struct{}) {
+			defer func() { d <- struct{}{} }()
+			b := make([]byte, 65536)
+			r := make(chan struct{}, 1)
+			for {
+				n, addr, err := c.ReadFrom(b)
+				p <- &packet{b: b[:n], addr: addr, err: err, done: r}
+				<-r
+
+				if err != nil && !IsTemporary(err) {
+					break
+				}
+			}
+		}(c, p, d)
+	}
+
+	return m
+}
+
+type multiPacketConn struct {
+	c []net.PacketConn // the list of connections
+	r []packetRoute    // the routes to each connection, for WriteTo
+	p <-chan *packet   // packets from ReadFrom are published on this channel
+	d <-chan struct{}  // each goroutine publishes to this channel when they exit
+	x chan struct{}    // closed when the connection is closed
+
+	// Read deadline of the connection, u is closed and replaced when the
+	// deadline changes to wake up goroutines blocked in ReadFrom.
+	mutex    sync.Mutex
+	deadline time.Time
+	u        chan struct{}
+
+	// Used by Close to allow multiple goroutines to call the method as well as
+	// allowing the method to be called multiple times.
+	once sync.Once
+}
+
+// packet is used to pass the result of a read from one of the connections to
+// ReadFrom, the buffer is reused after done is signaled.
+type packet struct {
+	b    []byte
+	addr net.Addr
+	err  error
+	done chan<- struct{}
+}
+
+// packetRoute is used to select the connection which packets are written to.
+type packetRoute struct {
+	net  *net.IPNet
+	zone string
+}
+
+func makePacketRoute(addr net.Addr) packetRoute {
+	ip, zone := addrIP(addr)
+
+	if ip == nil {
+		return packetRoute{}
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+
+	if ip.IsUnspecified() {
+		return packetRoute{net: &net.IPNet{IP: ip, Mask: net.CIDRMask(0, bits)}, zone: zone}
+	}
+
+	if ifa, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range ifa {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return packetRoute{net: &net.IPNet{IP: ip.Mask(n.Mask), Mask: n.Mask}, zone: zone}
+			}
+		}
+	}
+
+	return packetRoute{net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, zone: zone}
+}
+
+func (r packetRoute) family(ip net.IP) bool {
+	return r.net != nil && (len(r.net.IP) == net.IPv4len) == (ip.To4() != nil)
+}
+
+func (r packetRoute) match(ip net.IP, zone string) bool {
+	return r.net != nil && r.net.Contains(ip) && (len(zone) == 0 || len(r.zone) == 0 || zone == r.zone)
+}
+
+func addrIP(addr net.Addr) (ip net.IP, zone string) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, zone = a.IP, a.Zone
+	case *net.IPAddr:
+		ip, zone = a.IP, a.Zone
+	case *net.TCPAddr:
+		ip, zone = a.IP, a.Zone
+	default:
+		if addr != nil {
+			h, _ := SplitAddrPort(addr.String())
+			if i := strings.IndexByte(h, '%'); i >= 0 {
+				h, zone = h[:i], h[i+1:]
+			}
+			ip = net.ParseIP(h)
+		}
+	}
+	return
+}
+
+func (m *multiPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		m.mutex.Lock()
+		deadline, update := m.deadline, m.u
+		m.mutex.Unlock()
+
+		var timer *time.Timer
+		var expire <-chan time.Time
+
+		if !deadline.IsZero() {
+			d := deadline.Sub(time.Now())
+			if d <= 0 {
+				err = Timeout("read deadline exceeded")
+				return
+			}
+			timer = time.NewTimer(d)
+			expire = timer.C
+		}
+
+		done := true
+
+		select {
+		case p := <-m.p:
+			n, addr, err = copy(b, p.b), p.addr, p.err
+			p.done <- struct{}{}
+		case <-expire:
+			err = Timeout("read deadline exceeded")
+		case <-update:
+			done = false
+		case <-m.x:
+			err = io.ErrClosedPipe
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if done {
+			return
+		}
+	}
+}
+
+func (m *multiPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ip, zone := addrIP(addr)
+
+	if ip == nil {
+		if len(m.c) == 0 {
+			return 0, io.ErrClosedPipe
+		}
+		return m.c[0].WriteTo(b, addr)
+	}
+
+	for i, r := range m.r {
+		if r.match(ip, zone) {
+			return m.c[i].WriteTo(b, addr)
+		}
+	}
+
+	for i, r := range m.r {
+		if r.family(ip) {
+			return m.c[i].WriteTo(b, addr)
+		}
+	}
+
+	return 0, &net.OpError{
+		Op:   "write",
+		Net:  m.LocalAddr().Network(),
+		Addr: addr,
+		Err:  errors.New("no connection matching the destination address"),
+	}
+}
+
+func (m *multiPacketConn) Close() (err error) {
+	m.once.Do(func() {
+		var errs []string
+
+		for _, c := range m.c {
+			if e := c.Close(); e != nil {
+				errs = append(errs, e.Error())
+			}
+		}
+
+		for i, n := 0, len(m.c); i != n; {
+			select {
+			case p := <-m.p:
+				p.done <- struct{}{}
+			case <-m.d:
+				i++
+			}
+		}
+
+		if errs != nil {
+			err = errors.New(strings.Join(errs, "; "))
+		}
+
+		close(m.x)
+	})
+	return
+}
+
+func (m *multiPacketConn) LocalAddr() net.Addr {
+	a := make(MultiAddr, len(m.c))
+
+	for i, c := range m.c {
+		a[i] = c.LocalAddr()
+	}
+
+	return a
+}
+
+func (m *multiPacketConn) SetDeadline(t time.Time) error {
+	m.SetReadDeadline(t)
+	return m.SetWriteDeadline(t)
+}
+
+func (m *multiPacketConn) SetReadDeadline(t time.Time) error {
+	m.mutex.Lock()
+	m.deadline = t
+	close(m.u)
+	m.u = make(chan struct{})
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *multiPacketConn) SetWriteDeadline(t time.Time) (err error) {
+	for _, c := range m.c {
+		if e := c.SetWriteDeadline(t); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
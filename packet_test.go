@@ -0,0 +1,154 @@
+package netx
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiPacketConn(t *testing.T) {
+	c4, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c6, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		c4.Close()
+		t.Skip("IPv6 is not available:", err)
+	}
+
+	m := MultiPacketConn(c4, c6)
+	defer m.Close()
+
+	if a, ok := m.LocalAddr().(MultiAddr); !ok || len(a) != 2 {
+		t.Fatalf("bad local address: %#v", m.LocalAddr())
+	}
+
+	for _, local := range []net.Addr{c4.LocalAddr(), c6.LocalAddr()} {
+		t.Run(local.String(), func(t *testing.T) {
+			client, err := net.Dial("udp", local.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if _, err := client.Write([]byte("Hello World!")); err != nil {
+				t.Fatal(err)
+			}
+
+			b := make([]byte, 100)
+			m.SetReadDeadline(time.Now().Add(time.Second))
+
+			n, addr, err := m.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s := string(b[:n]); s != "Hello World!" {
+				t.Error("bad packet:", s)
+			}
+
+			if addr.String() != client.LocalAddr().String() {
+				t.Error("bad source address:", addr)
+			}
+
+			// The connection was dialed so the reply must come from the
+			// socket that the request was sent to, otherwise it is dropped.
+			if _, err := m.WriteTo([]byte("42"), addr); err != nil {
+				t.Fatal(err)
+			}
+
+			client.SetReadDeadline(time.Now().Add(time.Second))
+
+			if n, err = client.Read(b); err != nil {
+				t.Fatal(err)
+			}
+
+			if s := string(b[:n]); s != "42" {
+				t.Error("bad reply:", s)
+			}
+		})
+	}
+}
+
+func TestMultiPacketConnDeadline(t *testing.T) {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MultiPacketConn(c)
+	defer m.Close()
+
+	m.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	if _, _, err := m.ReadFrom(make([]byte, 100)); !IsTimeout(err) {
+		t.Error("expected a timeout error but got", err)
+	}
+}
+
+func TestMultiPacketConnClose(t *testing.T) {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MultiPacketConn(c)
+	done := make(chan error)
+
+	go func() {
+		_, _, err := m.ReadFrom(make([]byte, 100))
+		done <- err
+	}()
+
+	if err := m.Close(); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error after closing the connection")
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for ReadFrom to return")
+	}
+}
+
+func TestListenPacketInterface(t *testing.T) {
+	ifi := loopbackInterface(t)
+
+	conn, err := ListenPacket("udp://" + ifi.Name + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ifa, err := ifi.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ifa) > 1 {
+		if a, ok := conn.LocalAddr().(MultiAddr); !ok || len(a) != len(ifa) {
+			t.Errorf("bad local address: %s", conn.LocalAddr())
+		}
+	}
+}
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ifi := range ifis {
+		if (ifi.Flags & net.FlagLoopback) != 0 {
+			return &ifi
+		}
+	}
+
+	t.Skip("no loopback interface")
+	return nil
+}
@@ -4,21 +4,80 @@ import (
 	"errors"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 )
 
 // ConnPair returns a pair of connections, each of them being the end of a
 // bidirectional communcation channel. network should be one of "tcp", "tcp4",
 // "tcp6", or "unix".
+//
+// The network may also be an address with a protocol, as accepted by Listen, in
+// which case a temporary listener is created on that address to establish the
+// connections. This makes it possible to create pairs of unix connections bound
+// to a path or to a name in the abstract namespace (for example
+// "unix:///tmp/pair.sock?mkdir&unlink" or "unix://@pair"), which UnixConnPair
+// doesn't support.
 func ConnPair(network string) (net.Conn, net.Conn, error) {
 	switch network {
 	case "unix":
 		return UnixConnPair()
 	case "tcp", "tcp4", "tcp6":
 		return TCPConnPair(network)
-	default:
-		return nil, nil, errors.New("unsupported network pair: " + network)
 	}
+
+	if strings.Contains(network, "://") {
+		return listenConnPair(network)
+	}
+
+	return nil, nil, errors.New("unsupported network pair: " + network)
+}
+
+// listenConnPair returns a pair of connections established by accepting a
+// connection on a listener created for address.
+func listenConnPair(address string) (c1 net.Conn, c2 net.Conn, err error) {
+	var lstn net.Listener
+	var ch1 = make(chan error, 1)
+	var ch2 = make(chan net.Conn, 1)
+
+	if lstn, err = Listen(address); err != nil {
+		return
+	}
+	defer lstn.Close()
+
+	addr := lstn.Addr()
+
+	if m, ok := addr.(MultiAddr); ok {
+		addr = m[0]
+	}
+
+	go func() {
+		if conn, err := net.Dial(addr.Network(), addr.String()); err != nil {
+			// Closing the listener unblocks the call to Accept, which would
+			// otherwise wait forever for a connection that will never come.
+			ch1 <- err
+			lstn.Close()
+		} else {
+			ch2 <- conn
+		}
+	}()
+
+	if c1, err = lstn.Accept(); err != nil {
+		select {
+		case err = <-ch1:
+		case conn := <-ch2:
+			conn.Close()
+		}
+		return
+	}
+
+	select {
+	case c2 = <-ch2:
+	case err = <-ch1:
+		c1.Close()
+		c1 = nil
+	}
+	return
 }
 
 // TCPConnPair returns a pair of TCP connections, each of them being the end of a
@@ -59,6 +118,10 @@ func TCPConnPair(network string) (nc1 *net.TCPConn, nc2 *net.TCPConn, err error)
 
 // UnixConnPair returns a pair of unix connections, each of them being the end of a
 // bidirection communication channel.
+//
+// The connections are created with socketpair(2) and are not bound to any
+// address, use ConnPair with a unix:// address to create a pair of connections
+// on a path or abstract name.
 func UnixConnPair() (uc1 *net.UnixConn, uc2 *net.UnixConn, err error) {
 	var fd1 int
 	var fd2 int
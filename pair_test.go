@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	"golang.org/x/net/nettest"
 )
@@ -14,6 +15,7 @@ func TestConnPair(t *testing.T) {
 		"tcp",
 		"tcp4",
 		"tcp6",
+		"unix:///tmp/netx-pair/test.sock?mkdir&unlink",
 	} {
 		network := network // capture in lambda
 		t.Run(network, func(t *testing.T) {
@@ -70,3 +72,31 @@ func TestUnixConnPairCloseWrite(t *testing.T) {
 		return
 	}
 }
+
+func TestConnPairDialError(t *testing.T) {
+	// The listener can be bound to an address that isn't assigned to the host,
+	// connecting to it fails and must not leave ConnPair blocked on Accept.
+	if _, err := net.DialTimeout("tcp", "192.0.2.1:1", time.Second); IsTimeout(err) {
+		t.Skip("connecting to an unreachable address doesn't fail right away on this host")
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		c1, c2, err := ConnPair("tcp://192.0.2.1:0?freebind")
+		if err == nil {
+			c1.Close()
+			c2.Close()
+		}
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for ConnPair to return")
+	}
+}
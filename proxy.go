@@ -6,9 +6,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"strconv"
+	"time"
 )
 
 // ProxyHandler is an interface that must be implemented by types that intend to
@@ -78,67 +80,215 @@ func OriginalTargetAddr(conn net.Conn) (net.Addr, error) {
 	return originalTargetAddr(conn)
 }
 
+// ProxyPolicy values define how a ProxyProtocol handles connections depending
+// on whether they start with a proxy protocol header.
+type ProxyPolicy int
+
+const (
+	// ProxyRequire is the default policy, connections must start with a
+	// header.
+	ProxyRequire ProxyPolicy = iota
+
+	// ProxyOptional accepts connections with or without a header, the ones
+	// without are served with the addresses of the socket. This policy is
+	// useful when migrating to the proxy protocol, while some of the proxies
+	// don't send the headers yet.
+	//
+	// Connections are passed to the handler once the client has sent enough
+	// bytes to tell whether they start with a header, or when the timeout
+	// expires. Protocols where the server speaks first (SMTP, FTP, MySQL...)
+	// are stalled for the whole timeout, see ProxyProtocol.Timeout.
+	ProxyOptional
+
+	// ProxyReject refuses connections that start with a header, they are
+	// served with the addresses of the socket. Like ProxyOptional, it waits
+	// for the client to send data or for the timeout to expire before passing
+	// connections to the handler.
+	ProxyReject
+)
+
 // ProxyProtocol is the implementation of a connection handler which speaks
 // the proxy protocol.
 //
 // When the handler receives a LOCAL connection it handles the connection itself
 // and simply closes the connection.
 //
-// Version 1 and 2 are supported.
+// The connections passed to the handler report the source and destination
+// addresses received in the header as their remote and local addresses, the
+// rest of the header is available through ProxyHeaderOf.
+//
+// Version 1 and 2 are supported, including the TLVs of version 2.
 //
 // http://www.haproxy.org/download/1.5/doc/proxy-protocol.txt
 type ProxyProtocol struct {
 	Handler Handler
+
+	// Policy defines what the handler does with connections from trusted
+	// sources depending on whether they start with a header.
+	Policy ProxyPolicy
+
+	// Trusted is the list of networks that are allowed to send headers, all
+	// sources are trusted if the list is empty. Connections from other
+	// sources, including the ones which don't have an IP address, are served
+	// with the ProxyReject policy, which prevents clients from spoofing their
+	// address when they can connect to the server directly.
+	Trusted []*net.IPNet
+
+	// Timeout is the maximum amount of time that the handler waits for the
+	// header, it defaults to 10 seconds. When the policy allows connections
+	// without headers, the ones where the client did not send anything
+	// before the timeout are served with the addresses of the socket.
+	//
+	// Proxies send the header as soon as they establish the connection, so
+	// with ProxyOptional or ProxyReject in front of a protocol where the
+	// server speaks first, the timeout should be set to a short value (a few
+	// hundred milliseconds on a local network) to bound the delay before the
+	// clients that don't send headers get a greeting. Untrusted sources are
+	// served with ProxyReject and are subject to the same delay.
+	Timeout time.Duration
 }
 
 // ServeConn satisifies the Handler interface.
+//
+// The method panics to report errors.
 func (p *ProxyProtocol) ServeConn(ctx context.Context, conn net.Conn) {
-	src, _, buf, local, err := parseProxyProto(conn)
+	policy := p.Policy
+	timeout := p.Timeout
+
+	if !p.trusted(conn.RemoteAddr()) {
+		policy = ProxyReject
+	}
+
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	hdr, buf, err := readProxyProto(conn, policy)
+	conn.SetReadDeadline(time.Time{})
 
 	if err != nil {
-		panic(err)
+		fatal(conn, err)
 	}
 
-	if local {
+	if hdr == nil {
+		p.Handler.ServeConn(ctx, &replayConn{Conn: conn, buf: buf})
+		return
+	}
+
+	if hdr.Local {
 		conn.Close()
 		return
 	}
 
 	proxyConn := &proxyProtoConn{
-		Conn: conn,
-		src:  src,
-		buf:  buf,
+		replayConn: replayConn{Conn: conn, buf: buf},
+		hdr:        hdr,
 	}
 	p.Handler.ServeConn(ctx, proxyConn)
 }
 
-type proxyProtoConn struct {
-	net.Conn
-	src net.Addr
-	buf []byte
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	return proxyTrusted(addr, p.Trusted)
+}
+
+// proxyTrusted returns true if addr is in one of the trusted networks, or if
+// the list of networks is empty.
+func proxyTrusted(addr net.Addr, trusted []*net.IPNet) bool {
+	if len(trusted) == 0 {
+		return true
+	}
+
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readProxyProto reads the proxy protocol header from conn according to policy,
+// the returned header is nil if the connection did not start with one, in which
+// case buf contains the bytes read from the connection.
+func readProxyProto(conn net.Conn, policy ProxyPolicy) (hdr *ProxyHeader, buf []byte, err error) {
+	if policy == ProxyRequire {
+		return parseProxyProto(conn)
+	}
+
+	// The longest signature is 12 bytes, so reading 16 bytes is always enough
+	// to know whether the connection starts with a header.
+	var a [16]byte
+	var n int
+
+	for {
+		var m int
+		m, err = conn.Read(a[n:])
+		n += m
+
+		switch MatchProxyProtocol.Match(a[:n]) {
+		case Match:
+			if policy == ProxyReject {
+				err = fmt.Errorf("proxy protocol header received from %s which is not allowed to send one", conn.RemoteAddr())
+				return
+			}
+			return parseProxyProto(&replayConn{Conn: conn, buf: a[:n]})
+
+		case NoMatch:
+			return nil, a[:n], nil
+		}
+
+		if err != nil {
+			if err == io.EOF || IsTimeout(err) {
+				err = nil
+			}
+			return nil, a[:n], err
+		}
+	}
 }
 
-func (c *proxyProtoConn) Base() net.Conn {
-	return c.Conn
+type proxyProtoConn struct {
+	replayConn
+	hdr *ProxyHeader
 }
 
+// RemoteAddr returns the source address of the proxied connection, or the
+// address of the proxy if the header did not carry addresses.
 func (c *proxyProtoConn) RemoteAddr() net.Addr {
-	return c.src
+	if c.hdr.SrcAddr != nil {
+		return c.hdr.SrcAddr
+	}
+	return c.Conn.RemoteAddr()
 }
 
-func (c *proxyProtoConn) Read(b []byte) (n int, err error) {
-	if len(c.buf) != 0 {
-		n = copy(b, c.buf)
-		c.buf = c.buf[n:]
-		return
+// LocalAddr returns the destination address of the proxied connection, or the
+// local address of the connection to the proxy if the header did not carry
+// addresses.
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	if c.hdr.DstAddr != nil {
+		return c.hdr.DstAddr
 	}
-	return c.Conn.Read(b)
+	return c.Conn.LocalAddr()
 }
 
 var (
 	proxy     = [...]byte{'P', 'R', 'O', 'X', 'Y'}
 	tcp4      = [...]byte{'T', 'C', 'P', '4'}
 	tcp6      = [...]byte{'T', 'C', 'P', '6'}
+	unknown   = [...]byte{'U', 'N', 'K', 'N', 'O', 'W', 'N'}
 	crlf      = [...]byte{'\r', '\n'}
 	signature = [...]byte{'\x0D', '\x0A', '\x0D', '\x0A', '\x00', '\x0D', '\x0A', '\x51', '\x55', '\x49', '\x54', '\x0A'}
 )
@@ -175,7 +325,7 @@ func appendProxyProtoV1(b []byte, src net.Addr, dst net.Addr) []byte {
 	return b
 }
 
-func appendProxyProtoV2(b []byte, src net.Addr, dst net.Addr, local bool) []byte {
+func appendProxyProtoV2(b []byte, src net.Addr, dst net.Addr, local bool, tlvs ...ProxyTLV) []byte {
 	const (
 		AF_UNSPEC = 0
 		AF_INET   = 1
@@ -213,44 +363,49 @@ func appendProxyProtoV2(b []byte, src net.Addr, dst net.Addr, local bool) []byte
 		vercmd |= PROXY
 	}
 
+	// Addresses of different types cannot be represented in the header, the
+	// family is left unspecified in that case.
 	switch a := src.(type) {
 	case *net.TCPAddr:
-		b := dst.(*net.TCPAddr)
-		socktype, srcIP, dstIP = STREAM, a.IP, b.IP
-		srcPort = srcPortBuf[:]
-		dstPort = dstPortBuf[:]
-		binary.BigEndian.PutUint16(srcPort, uint16(a.Port))
-		binary.BigEndian.PutUint16(dstPort, uint16(b.Port))
+		if b, ok := dst.(*net.TCPAddr); ok {
+			socktype, srcIP, dstIP = STREAM, a.IP, b.IP
+			srcPort = srcPortBuf[:]
+			dstPort = dstPortBuf[:]
+			binary.BigEndian.PutUint16(srcPort, uint16(a.Port))
+			binary.BigEndian.PutUint16(dstPort, uint16(b.Port))
+		}
 
 	case *net.UDPAddr:
-		b := dst.(*net.UDPAddr)
-		socktype, srcIP, dstIP = DGRAM, a.IP, b.IP
-		srcPort = srcPortBuf[:]
-		dstPort = dstPortBuf[:]
-		binary.BigEndian.PutUint16(srcPort, uint16(a.Port))
-		binary.BigEndian.PutUint16(dstPort, uint16(b.Port))
+		if b, ok := dst.(*net.UDPAddr); ok {
+			socktype, srcIP, dstIP = DGRAM, a.IP, b.IP
+			srcPort = srcPortBuf[:]
+			dstPort = dstPortBuf[:]
+			binary.BigEndian.PutUint16(srcPort, uint16(a.Port))
+			binary.BigEndian.PutUint16(dstPort, uint16(b.Port))
+		}
 
 	case *net.UnixAddr:
-		b := dst.(*net.UnixAddr)
-		family = AF_UNIX
-		srcAddr = srcAddrBuf[:]
-		dstAddr = dstAddrBuf[:]
-		copy(srcAddr, a.Name)
-		copy(dstAddr, b.Name)
-
-		switch a.Net {
-		case "unix":
-			socktype = STREAM
-		case "unixgram":
-			socktype = DGRAM
+		if b, ok := dst.(*net.UnixAddr); ok {
+			family = AF_UNIX
+			srcAddr = srcAddrBuf[:]
+			dstAddr = dstAddrBuf[:]
+			copy(srcAddr, a.Name)
+			copy(dstAddr, b.Name)
+
+			switch a.Net {
+			case "unix":
+				socktype = STREAM
+			case "unixgram":
+				socktype = DGRAM
+			}
 		}
 	}
 
 	if srcIP != nil {
-		if ip := srcIP.To4(); ip != nil {
+		if ip1, ip2 := srcIP.To4(), dstIP.To4(); ip1 != nil && ip2 != nil {
 			family = AF_INET
-			srcAddr = ip
-			dstAddr = dstIP.To4()
+			srcAddr = ip1
+			dstAddr = ip2
 		} else {
 			family = AF_INET6
 			srcAddr = srcIP.To16()
@@ -258,17 +413,43 @@ func appendProxyProtoV2(b []byte, src net.Addr, dst net.Addr, local bool) []byte
 		}
 	}
 
+	size := len(srcAddr) + len(dstAddr) + len(srcPort) + len(dstPort)
+
+	for _, tlv := range tlvs {
+		size += 3 + len(tlv.Value)
+	}
+
+	start := len(b)
 	b = append(b, signature[:]...)
 	b = append(b, vercmd)
 	b = append(b, (family<<4)|socktype)
+	b = append(b, byte(size>>8), byte(size))
 	b = append(b, srcAddr...)
 	b = append(b, dstAddr...)
 	b = append(b, srcPort...)
 	b = append(b, dstPort...)
+
+	crc := -1
+
+	for _, tlv := range tlvs {
+		b = append(b, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+
+		if tlv.Type == ProxyTLVCRC32C && len(tlv.Value) == 4 {
+			crc = len(b)
+			b = append(b, 0, 0, 0, 0)
+		} else {
+			b = append(b, tlv.Value...)
+		}
+	}
+
+	if crc >= 0 {
+		binary.BigEndian.PutUint32(b[crc:], crc32.Checksum(b[start:], crc32c))
+	}
+
 	return b
 }
 
-func parseProxyProto(r io.Reader) (src net.Addr, dst net.Addr, buf []byte, local bool, err error) {
+func parseProxyProto(r io.Reader) (hdr *ProxyHeader, buf []byte, err error) {
 	var a [256]byte
 	var b []byte
 	var n int
@@ -297,76 +478,42 @@ func parseProxyProto(r io.Reader) (src net.Addr, dst net.Addr, buf []byte, local
 			i = bytes.Index(b, crlf[:])
 		}
 
-		src, dst, err = parseProxyProtoV1(b[:i])
+		hdr = &ProxyHeader{Version: 1}
+		hdr.SrcAddr, hdr.DstAddr, err = parseProxyProtoV1(b[:i])
 		buf = b[i+2:]
 		return
 
 	case bytes.HasPrefix(b, signature[:]):
-		b = b[len(signature):]
-
-		if version := b[0] >> 4; version != 2 {
-			err = fmt.Errorf("invalid proxy protocol version: %#x", version)
-			return
-		}
-
-		switch cmd := b[0] & 0xF; cmd {
-		case 0:
-			local = true
-		case 1:
-		default:
-			err = fmt.Errorf("invalid proxy protocol command: %#x", cmd)
-			return
-		}
-
-		var makeStreamAddr = makeTCPAddr
-		var makeDgramAddr = makeUDPAddr
-		var makeAddr func(int, []byte, []byte) net.Addr
-		var addrLen int
-		var portLen int
-		var socktype int
-
-		switch family := b[1] >> 4; family {
-		case 0: // AF_UNSPEC
-		case 1: // AF_INET
-			addrLen, portLen = 4, 2
-		case 2: // AF_INET6
-			addrLen, portLen = 16, 2
-		case 3: // AF_UNIX
-			addrLen, portLen = 108, 0
-			makeStreamAddr, makeDgramAddr = makeUnixAddr, makeUnixAddr
-		default:
-			err = fmt.Errorf("invalid socket family found in proxy protocol header: %#x", family)
-			return
+		// The fixed part of the header is 16 bytes long and ends with the
+		// length of the addresses and TLVs that follow.
+		if len(b) < 16 {
+			if _, err = io.ReadFull(r, a[len(b):16]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+			b = a[:16]
 		}
 
-		switch socktype = int(b[1] & 0xF); socktype {
-		case 0: // UNSPEC
-		case 1: // STREAM
-			makeAddr = makeStreamAddr
-		case 2: // DGRAM
-			makeAddr = makeDgramAddr
-		default:
-			err = fmt.Errorf("invalid socket type found in proxy protocol header: %#x", socktype)
-			return
-		}
-		b = b[2:]
+		size := 16 + int(binary.BigEndian.Uint16(b[14:16]))
 
-		n1 := 2*addrLen + 2*portLen
-		n2 := len(b)
+		if len(b) < size {
+			h := make([]byte, size)
+			n = copy(h, b)
 
-		if n1 > n2 {
-			if _, err = io.ReadFull(r, b[n2:n1]); err != nil {
+			if _, err = io.ReadFull(r, h[n:]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
 				return
 			}
-			b = b[:n1]
-		}
 
-		if makeAddr != nil {
-			src = makeAddr(socktype, b[:addrLen], b[2*addrLen:2*addrLen+portLen])
-			dst = makeAddr(socktype, b[addrLen:2*addrLen], b[2*addrLen+portLen:])
+			b = h
 		}
 
-		buf = b[n1:]
+		hdr, err = parseProxyProtoV2(b[:size])
+		buf = b[size:]
 		return
 	}
 
@@ -374,6 +521,74 @@ func parseProxyProto(r io.Reader) (src net.Addr, dst net.Addr, buf []byte, local
 	return
 }
 
+func parseProxyProtoV2(b []byte) (hdr *ProxyHeader, err error) {
+	hdr = &ProxyHeader{Version: 2}
+	h := b[len(signature):]
+
+	if version := h[0] >> 4; version != 2 {
+		err = fmt.Errorf("invalid proxy protocol version: %#x", version)
+		return
+	}
+
+	switch cmd := h[0] & 0xF; cmd {
+	case 0:
+		hdr.Local = true
+	case 1:
+	default:
+		err = fmt.Errorf("invalid proxy protocol command: %#x", cmd)
+		return
+	}
+
+	var makeStreamAddr = makeTCPAddr
+	var makeDgramAddr = makeUDPAddr
+	var makeAddr func(int, []byte, []byte) net.Addr
+	var addrLen int
+	var portLen int
+	var socktype int
+
+	switch family := h[1] >> 4; family {
+	case 0: // AF_UNSPEC
+	case 1: // AF_INET
+		addrLen, portLen = 4, 2
+	case 2: // AF_INET6
+		addrLen, portLen = 16, 2
+	case 3: // AF_UNIX
+		addrLen, portLen = 108, 0
+		makeStreamAddr, makeDgramAddr = makeUnixAddr, makeUnixAddr
+	default:
+		err = fmt.Errorf("invalid socket family found in proxy protocol header: %#x", family)
+		return
+	}
+
+	switch socktype = int(h[1] & 0xF); socktype {
+	case 0: // UNSPEC
+	case 1: // STREAM
+		makeAddr = makeStreamAddr
+	case 2: // DGRAM
+		makeAddr = makeDgramAddr
+	default:
+		err = fmt.Errorf("invalid socket type found in proxy protocol header: %#x", socktype)
+		return
+	}
+	h = h[4:]
+
+	n := 2*addrLen + 2*portLen
+
+	if n > len(h) {
+		err = fmt.Errorf("proxy protocol header too short to contain the addresses: %d < %d", len(h), n)
+		return
+	}
+
+	// Receivers must ignore the addresses of LOCAL connections.
+	if makeAddr != nil && !hdr.Local {
+		hdr.SrcAddr = makeAddr(socktype, h[:addrLen], h[2*addrLen:2*addrLen+portLen])
+		hdr.DstAddr = makeAddr(socktype, h[addrLen:2*addrLen], h[2*addrLen+portLen:n])
+	}
+
+	err = parseProxyProtoTLVs(hdr, b, h[n:])
+	return
+}
+
 func parseProxyProtoV1(b []byte) (src net.Addr, dst net.Addr, err error) {
 	var family, srcIP, srcPort, dstIP, dstPort []byte
 
@@ -395,6 +610,10 @@ func parseProxyProtoV1(b []byte) (src net.Addr, dst net.Addr, err error) {
 	switch {
 	case bytes.Equal(family, tcp4[:]):
 	case bytes.Equal(family, tcp6[:]):
+	case bytes.Equal(family, unknown[:]):
+		// The rest of the line must be ignored, the proxy could not represent
+		// the addresses of the connection.
+		return
 	default:
 		err = fmt.Errorf("invalid socket family found in proxy protocol header: %s", string(family))
 		return
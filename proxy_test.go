@@ -1,11 +1,15 @@
 package netx
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type readOneByOne struct {
@@ -49,26 +53,26 @@ func TestProxyProtoV1(t *testing.T) {
 			}
 
 			r := &readOneByOne{b}
-			a1, a2, buf, local, err := parseProxyProto(r)
+			hdr, buf, err := parseProxyProto(r)
 
 			if err != nil {
-				t.Error(err)
+				t.Fatal(err)
 			}
 
 			if len(r.b) != 0 || len(buf) != 0 {
 				t.Error("unexpected trailing bytes")
 			}
 
-			if !reflect.DeepEqual(test.src, a1) {
-				t.Errorf("bad source: %#v", a1)
+			if !reflect.DeepEqual(test.src, hdr.SrcAddr) {
+				t.Errorf("bad source: %#v", hdr.SrcAddr)
 			}
 
-			if !reflect.DeepEqual(test.dst, a2) {
-				t.Errorf("bad destination: %#v", a2)
+			if !reflect.DeepEqual(test.dst, hdr.DstAddr) {
+				t.Errorf("bad destination: %#v", hdr.DstAddr)
 			}
 
-			if local {
-				t.Errorf("bad local: %t", local)
+			if hdr.Local {
+				t.Errorf("bad local: %t", hdr.Local)
 			}
 		})
 	}
@@ -110,26 +114,26 @@ func TestProxyProtoV2(t *testing.T) {
 		t.Run(fmt.Sprintf("%s://%s->%s", test.src.Network(), test.src, test.dst), func(t *testing.T) {
 			b := appendProxyProtoV2(nil, test.src, test.dst, false)
 			r := &readOneByOne{b}
-			a1, a2, buf, local, err := parseProxyProto(r)
+			hdr, buf, err := parseProxyProto(r)
 
 			if err != nil {
-				t.Error(err)
+				t.Fatal(err)
 			}
 
 			if len(r.b) != 0 || len(buf) != 0 {
 				t.Errorf("unexpected trailing bytes: %#v %#v", r.b, buf)
 			}
 
-			if !reflect.DeepEqual(test.src, a1) {
-				t.Errorf("bad source: %#v", a1)
+			if !reflect.DeepEqual(test.src, hdr.SrcAddr) {
+				t.Errorf("bad source: %#v", hdr.SrcAddr)
 			}
 
-			if !reflect.DeepEqual(test.dst, a2) {
-				t.Errorf("bad destination: %#v", a2)
+			if !reflect.DeepEqual(test.dst, hdr.DstAddr) {
+				t.Errorf("bad destination: %#v", hdr.DstAddr)
 			}
 
-			if local {
-				t.Errorf("bad local state: %t", local)
+			if hdr.Local {
+				t.Errorf("bad local state: %t", hdr.Local)
 			}
 		})
 	}
@@ -138,25 +142,113 @@ func TestProxyProtoV2(t *testing.T) {
 func TestProxyProtoV2Local(t *testing.T) {
 	b := appendProxyProtoV2(nil, &NetAddr{}, &NetAddr{}, true)
 	r := &readOneByOne{b}
-	src, dst, buf, local, err := parseProxyProto(r)
+	hdr, buf, err := parseProxyProto(r)
 
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
 	if len(r.b) != 0 || len(buf) != 0 {
 		t.Errorf("unexpected trailing bytes: %#v %#v", r.b, buf)
 	}
 
-	if src != nil {
-		t.Errorf("bad source: %#v", src)
+	if hdr.SrcAddr != nil {
+		t.Errorf("bad source: %#v", hdr.SrcAddr)
 	}
 
-	if dst != nil {
-		t.Errorf("bad destination: %#v", dst)
+	if hdr.DstAddr != nil {
+		t.Errorf("bad destination: %#v", hdr.DstAddr)
 	}
 
-	if !local {
-		t.Errorf("bad local state: %t", local)
+	if !hdr.Local {
+		t.Errorf("bad local state: %t", hdr.Local)
+	}
+}
+
+func TestProxyProtocolPolicy(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 56789 443\r\n"
+
+	tests := []struct {
+		name    string
+		policy  ProxyPolicy
+		trusted []*net.IPNet
+		send    string
+		remote  string // "" means the socket address, "-" means rejected
+	}{
+		{"require", ProxyRequire, nil, header + "hello", "192.0.2.1:56789"},
+		{"require-no-header", ProxyRequire, nil, "hello", "-"},
+		{"optional", ProxyOptional, nil, header + "hello", "192.0.2.1:56789"},
+		{"optional-no-header", ProxyOptional, nil, "hello", ""},
+		{"optional-short", ProxyOptional, nil, "PRO", ""},
+		{"optional-timeout", ProxyOptional, nil, "", ""},
+		{"reject", ProxyReject, nil, header + "hello", "-"},
+		{"reject-no-header", ProxyReject, nil, "hello", ""},
+		{"trusted", ProxyRequire, []*net.IPNet{other, loopback}, header + "hello", "192.0.2.1:56789"},
+		{"untrusted", ProxyRequire, []*net.IPNet{other}, header + "hello", "-"},
+		{"untrusted-no-header", ProxyRequire, []*net.IPNet{other}, "hello", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			type result struct {
+				remote string
+				data   string
+			}
+
+			results := make(chan result, 1)
+
+			addr, close := listenAndServe(&ProxyProtocol{
+				Policy:  test.policy,
+				Trusted: test.trusted,
+				Timeout: 100 * time.Millisecond,
+				Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+					defer conn.Close()
+					b, _ := ioutil.ReadAll(conn)
+					results <- result{remote: conn.RemoteAddr().String(), data: string(b)}
+				}),
+			})
+			defer close()
+
+			conn, err := net.Dial("tcp", addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if len(test.send) == 0 {
+				time.Sleep(200 * time.Millisecond)
+			} else {
+				io.WriteString(conn, test.send)
+			}
+			conn.(*net.TCPConn).CloseWrite()
+
+			// The server closes the connection whether it was rejected or
+			// served.
+			ioutil.ReadAll(conn)
+
+			var res result
+
+			select {
+			case res = <-results:
+			default:
+				res.remote = "-"
+			}
+
+			remote := test.remote
+			if len(remote) == 0 {
+				remote = conn.LocalAddr().String()
+			}
+
+			if res.remote != remote {
+				t.Errorf("bad remote address: %s != %s", remote, res.remote)
+			}
+
+			if data := strings.TrimPrefix(test.send, header); res.remote != "-" && res.data != data {
+				t.Errorf("bad data: %q != %q", data, res.data)
+			}
+		})
 	}
 }
@@ -0,0 +1,161 @@
+package netx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyPacketRouteTimeout is the amount of time after which the proxy that a
+// client was last seen through is forgotten, it matches the default timeout of
+// UDP flows in load balancers and connection tracking tables.
+var proxyPacketRouteTimeout = 2 * time.Minute
+
+// ProxyPacketConn returns a packet connection which reads datagrams prefixed
+// with a header of version 2 of the proxy protocol, like the ones that HAProxy
+// or AWS network load balancers send when proxying UDP traffic.
+//
+// ReadFrom strips the header and returns the source address that it carries,
+// datagrams which don't start with a valid header, or that are LOCAL commands
+// sent by the proxy for health checks, are discarded. WriteTo sends datagrams
+// to the proxy that the destination address was last received from, without
+// a header; it returns an error if no datagrams were received from the
+// address in the last two minutes.
+//
+// trusted is the list of networks that proxies are allowed to send datagrams
+// from, all senders are trusted if the list is empty. Datagrams from other
+// senders are discarded, which prevents clients that can reach the socket
+// directly from spoofing their address or capturing the responses sent to
+// other clients.
+func ProxyPacketConn(conn net.PacketConn, trusted ...*net.IPNet) net.PacketConn {
+	return &proxyPacketConn{
+		PacketConn: conn,
+		trusted:    trusted,
+		routes:     make(map[string]*proxyPacketRoute),
+		sweep:      time.Now(),
+	}
+}
+
+type proxyPacketConn struct {
+	net.PacketConn
+	trusted []*net.IPNet
+	mutex   sync.Mutex
+	routes  map[string]*proxyPacketRoute // proxies indexed by client address
+	sweep   time.Time                    // last time expired routes were removed
+}
+
+type proxyPacketRoute struct {
+	proxy net.Addr
+	seen  time.Time
+}
+
+var proxyPacketBuffers = sync.Pool{
+	New: func() interface{} { return make([]byte, 65536) },
+}
+
+func (c *proxyPacketConn) BasePacketConn() net.PacketConn {
+	return c.PacketConn
+}
+
+func (c *proxyPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	buf := proxyPacketBuffers.Get().([]byte)
+	defer proxyPacketBuffers.Put(buf)
+
+	for {
+		var proxy net.Addr
+		var hdr *ProxyHeader
+		var payload []byte
+		var m int
+
+		if m, proxy, err = c.PacketConn.ReadFrom(buf); err != nil {
+			return
+		}
+
+		if !proxyTrusted(proxy, c.trusted) {
+			continue
+		}
+
+		if hdr, payload, err = parseProxyProtoPacket(buf[:m]); err != nil || hdr.Local || hdr.SrcAddr == nil {
+			continue
+		}
+
+		c.addRoute(hdr.SrcAddr, proxy)
+		return copy(b, payload), hdr.SrcAddr, nil
+	}
+}
+
+func (c *proxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	proxy, ok := c.route(addr)
+	if !ok {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    c.LocalAddr().Network(),
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    errors.New("no proxy known to route datagrams to this address"),
+		}
+	}
+	return c.PacketConn.WriteTo(b, proxy)
+}
+
+func (c *proxyPacketConn) addRoute(addr net.Addr, proxy net.Addr) {
+	now := time.Now()
+	key := addr.String()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if r := c.routes[key]; r != nil {
+		r.proxy, r.seen = proxy, now
+	} else {
+		c.routes[key] = &proxyPacketRoute{proxy: proxy, seen: now}
+	}
+
+	if now.Sub(c.sweep) >= proxyPacketRouteTimeout {
+		for k, r := range c.routes {
+			if now.Sub(r.seen) >= proxyPacketRouteTimeout {
+				delete(c.routes, k)
+			}
+		}
+		c.sweep = now
+	}
+}
+
+func (c *proxyPacketConn) route(addr net.Addr) (net.Addr, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r := c.routes[addr.String()]
+	if r == nil || time.Since(r.seen) >= proxyPacketRouteTimeout {
+		return nil, false
+	}
+
+	return r.proxy, true
+}
+
+// parseProxyProtoPacket parses the proxy protocol header at the beginning of the
+// datagram in b, and returns the payload that follows.
+func parseProxyProtoPacket(b []byte) (hdr *ProxyHeader, payload []byte, err error) {
+	if len(b) < 16 || !bytes.HasPrefix(b, signature[:]) {
+		err = errors.New("no proxy protocol v2 header found at the beginning of the datagram")
+		return
+	}
+
+	size := 16 + int(binary.BigEndian.Uint16(b[14:16]))
+
+	if size > len(b) {
+		err = fmt.Errorf("the proxy protocol header is longer than the datagram: %d > %d", size, len(b))
+		return
+	}
+
+	if hdr, err = parseProxyProtoV2(b[:size]); err != nil {
+		return
+	}
+
+	payload = b[size:]
+	return
+}
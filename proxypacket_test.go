@@ -0,0 +1,169 @@
+package netx
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyPacketConn(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := ProxyPacketConn(server)
+	defer conn.Close()
+
+	proxy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789}
+	target := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+
+	// Datagrams without a header, and health checks sent by the proxy, are
+	// not returned by ReadFrom.
+	proxy.WriteTo([]byte("no header"), server.LocalAddr())
+	proxy.WriteTo(appendProxyProtoV2(nil, client, target, true), server.LocalAddr())
+	proxy.WriteTo(append(appendProxyProtoV2(nil, client, target, false), "Hello World!"...), server.LocalAddr())
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 100)
+
+	n, addr, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b[:n]); s != "Hello World!" {
+		t.Error("bad payload:", s)
+	}
+
+	if addr.String() != client.String() || addr.Network() != "udp" {
+		t.Error("bad source address:", addr.Network(), addr)
+	}
+
+	if _, err := conn.WriteTo([]byte("Hi!"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, from, err := proxy.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b[:n]); s != "Hi!" {
+		t.Error("bad response:", s)
+	}
+
+	if from.String() != server.LocalAddr().String() {
+		t.Error("bad response address:", from)
+	}
+
+	if _, err := conn.WriteTo([]byte("Hi!"), target); err == nil {
+		t.Error("expected an error when writing to an unknown address")
+	}
+}
+
+func TestProxyPacketConnRouteTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { proxyPacketRouteTimeout = timeout }(proxyPacketRouteTimeout)
+	proxyPacketRouteTimeout = 10 * time.Millisecond
+
+	c := ProxyPacketConn(nil).(*proxyPacketConn)
+	a1 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	a2 := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2}
+	proxy := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3}
+
+	c.addRoute(a1, proxy)
+
+	if p, ok := c.route(a1); !ok || p != proxy {
+		t.Error("bad route:", p, ok)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := c.route(a1); ok {
+		t.Error("the route did not expire")
+	}
+
+	c.addRoute(a2, proxy)
+
+	if len(c.routes) != 1 {
+		t.Error("expired routes were not removed:", len(c.routes))
+	}
+}
+
+func TestParseProxyProtoPacketError(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789}
+	target := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+	b := appendProxyProtoV2(nil, client, target, false)
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"v1", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56789 53\r\n")},
+		{"truncated", b[:len(b)-1]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := parseProxyProtoPacket(test.data); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestProxyPacketConnTrusted(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789}
+	target := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+
+	for _, test := range []struct {
+		name    string
+		trusted []*net.IPNet
+		allowed bool
+	}{
+		{"trusted", []*net.IPNet{private, loopback}, true},
+		{"untrusted", []*net.IPNet{private}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := ProxyPacketConn(server, test.trusted...)
+			defer conn.Close()
+
+			proxy, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+
+			proxy.WriteTo(append(appendProxyProtoV2(nil, client, target, false), "Hello World!"...), server.LocalAddr())
+
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, addr, err := conn.ReadFrom(make([]byte, 100))
+
+			switch {
+			case test.allowed && err != nil:
+				t.Error(err)
+			case !test.allowed && err == nil:
+				t.Error("datagram received from an untrusted sender:", addr)
+			case !test.allowed && !IsTimeout(err):
+				t.Error(err)
+			}
+
+			if _, err := conn.WriteTo([]byte("Hi!"), client); (err == nil) != test.allowed {
+				t.Error("bad route to the client:", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package netx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Types of the TLVs of version 2 of the proxy protocol.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+	ProxyTLVAWS       = 0xEA
+	ProxyTLVAzure     = 0xEE
+)
+
+// Subtypes of the TLVs of type ProxyTLVSSL.
+const (
+	ProxyTLVSSLVersion = 0x21
+	ProxyTLVSSLCN      = 0x22
+	ProxyTLVSSLCipher  = 0x23
+	ProxyTLVSSLSigAlg  = 0x24
+	ProxyTLVSSLKeyAlg  = 0x25
+)
+
+const (
+	// proxyAWSVPCEndpointID is the subtype of the AWS TLV which carries the ID
+	// of the VPC endpoint that a connection was received on.
+	proxyAWSVPCEndpointID = 0x01
+
+	// The unique ID of a connection must not be longer than 128 bytes.
+	maxProxyUniqueIDSize = 128
+)
+
+// Flags of the client field of TLVs of type ProxyTLVSSL.
+const (
+	proxyClientSSL      = 0x01
+	proxyClientCertConn = 0x02
+	proxyClientCertSess = 0x04
+)
+
+// ProxyHeader carries the information received in the header of a proxied
+// connection.
+//
+// Handlers of a ProxyProtocol can retrieve the header with ProxyHeaderOf.
+// Programs acting as proxies use the WriteTo or Append methods to send headers
+// to backend servers, only the Version, Local, SrcAddr, DstAddr and TLVs fields
+// are used when writing a header.
+type ProxyHeader struct {
+	// Version of the proxy protocol that the header was received with, 1 or 2.
+	Version int
+
+	// Local is true for connections that the proxy established on its own,
+	// for example to run health checks.
+	Local bool
+
+	// The source and destination addresses of the proxied connection, nil if
+	// the proxy didn't send them.
+	SrcAddr net.Addr
+	DstAddr net.Addr
+
+	// TLVs is the list of all the TLVs found in the header, in the order they
+	// were received. Only version 2 of the protocol supports TLVs.
+	TLVs []ProxyTLV
+
+	// ALPN is the application protocol negotiated by the client with the
+	// proxy.
+	ALPN string
+
+	// Authority is the host name that the client intended to reach, typically
+	// the server name that it sent when negotiating TLS with the proxy.
+	Authority string
+
+	// UniqueID is an opaque identifier of the connection generated by the
+	// proxy.
+	UniqueID []byte
+
+	// SSL carries information about the TLS session that the client
+	// established with the proxy, nil if it did not connect over TLS.
+	SSL *ProxySSL
+
+	// NetNS is the name of the network namespace that the connection was
+	// received in by the proxy.
+	NetNS string
+
+	// AWSVPCEndpointID is the ID of the VPC endpoint that the connection was
+	// received on, when the proxy is an AWS network load balancer.
+	AWSVPCEndpointID string
+}
+
+// Append encodes h and appends it to b.
+//
+// Addresses that are not of type *net.TCPAddr, *net.UDPAddr or *net.UnixAddr
+// are converted if they are made of an IP address and a port, otherwise the
+// header is written without addresses (UNKNOWN in version 1, AF_UNSPEC in
+// version 2). When the list of TLVs has a TLV of type ProxyTLVCRC32C with a
+// 4 bytes value, the value is replaced by the checksum of the header.
+func (h *ProxyHeader) Append(b []byte) ([]byte, error) {
+	src := proxyHeaderAddr(h.SrcAddr)
+	dst := proxyHeaderAddr(h.DstAddr)
+
+	switch h.Version {
+	case 1:
+		if len(h.TLVs) != 0 {
+			return b, errors.New("TLVs are not supported by version 1 of the proxy protocol")
+		}
+
+		s, ok1 := src.(*net.TCPAddr)
+		d, ok2 := dst.(*net.TCPAddr)
+
+		if h.Local || !ok1 || !ok2 || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+			b = append(b, proxy[:]...)
+			b = append(b, ' ')
+			b = append(b, unknown[:]...)
+			b = append(b, crlf[:]...)
+			return b, nil
+		}
+
+		return appendProxyProtoV1(b, s, d), nil
+
+	case 2:
+		size := 216 // largest address block (AF_UNIX)
+
+		for _, tlv := range h.TLVs {
+			size += 3 + len(tlv.Value)
+		}
+
+		if size > 65535 {
+			return b, fmt.Errorf("the TLVs are too large to fit in a proxy protocol header: %d bytes", size)
+		}
+
+		return appendProxyProtoV2(b, src, dst, h.Local, h.TLVs...), nil
+
+	default:
+		return b, fmt.Errorf("unsupported proxy protocol version: %d", h.Version)
+	}
+}
+
+// WriteTo writes h to w, it satisfies the io.WriterTo interface.
+//
+// The header is written with a single call to w.Write.
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Append(nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// proxyHeaderAddr converts addr to one of the address types that can be written
+// in proxy protocol headers, or returns nil if it isn't made of an IP address
+// and port.
+func proxyHeaderAddr(addr net.Addr) net.Addr {
+	switch addr.(type) {
+	case nil, *net.TCPAddr, *net.UDPAddr, *net.UnixAddr:
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil
+	}
+
+	if strings.HasPrefix(addr.Network(), "udp") {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// ProxyTLV represents a type-length-value field of a proxy protocol header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxySSL carries the information of TLVs of type ProxyTLVSSL.
+type ProxySSL struct {
+	// Client is true if the client connected to the proxy over SSL or TLS.
+	Client bool
+
+	// CertConn is true if the client presented a certificate over the
+	// connection, CertSess is true if it presented one at least once over the
+	// TLS session the connection belongs to.
+	CertConn bool
+	CertSess bool
+
+	// Verified is true if the client presented a certificate and it was
+	// successfully verified by the proxy.
+	Verified bool
+
+	// Version is the version of the protocol, for example "TLSv1.3".
+	Version string
+
+	// CommonName is the common name of the subject of the client certificate.
+	CommonName string
+
+	// Cipher is the name of the cipher used, for example
+	// "ECDHE-RSA-AES128-GCM-SHA256".
+	Cipher string
+
+	// SigAlg and KeyAlg are the algorithms used to sign the certificate
+	// presented by the proxy, and to generate its key.
+	SigAlg string
+	KeyAlg string
+}
+
+// ProxyHeaderOf returns the proxy protocol header that a ProxyProtocol received
+// on conn, or false if conn wasn't passed to a handler by a ProxyProtocol (or
+// was wrapped in a way that BaseConn cannot see through).
+func ProxyHeaderOf(conn net.Conn) (*ProxyHeader, bool) {
+	if c, ok := findConn(conn, isProxyProtoConn).(*proxyProtoConn); ok {
+		return c.hdr, true
+	}
+	return nil, false
+}
+
+func isProxyProtoConn(conn net.Conn) bool {
+	_, ok := conn.(*proxyProtoConn)
+	return ok
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// parseProxyProtoTLVs parses the TLVs in b and sets the fields of hdr, header is
+// the whole proxy protocol header which is used to verify the checksum if it
+// has one.
+func parseProxyProtoTLVs(hdr *ProxyHeader, header []byte, b []byte) error {
+	for len(b) != 0 {
+		if len(b) < 3 {
+			return errors.New("truncated TLV found in proxy protocol header")
+		}
+
+		typ := b[0]
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+
+		if len(b) < 3+n {
+			return fmt.Errorf("TLV of type %#x in proxy protocol header is longer than the header: %d > %d", typ, n, len(b)-3)
+		}
+
+		value := b[3 : 3+n]
+		b = b[3+n:]
+
+		switch typ {
+		case ProxyTLVALPN:
+			hdr.ALPN = string(value)
+
+		case ProxyTLVAuthority:
+			hdr.Authority = string(value)
+
+		case ProxyTLVCRC32C:
+			if len(value) != 4 {
+				return fmt.Errorf("invalid length of the CRC32C TLV in proxy protocol header: %d", len(value))
+			}
+
+			// The checksum is computed over the whole header with the value
+			// of the checksum itself set to zero.
+			off := len(header) - len(b) - 4
+			sum := binary.BigEndian.Uint32(value)
+
+			c := crc32.Update(0, crc32c, header[:off])
+			c = crc32.Update(c, crc32c, make([]byte, 4))
+			c = crc32.Update(c, crc32c, header[off+4:])
+
+			if c != sum {
+				return fmt.Errorf("invalid checksum of proxy protocol header: %#08x != %#08x", c, sum)
+			}
+
+		case ProxyTLVUniqueID:
+			if len(value) > maxProxyUniqueIDSize {
+				return fmt.Errorf("unique ID in proxy protocol header is longer than %d bytes: %d", maxProxyUniqueIDSize, len(value))
+			}
+			hdr.UniqueID = value
+
+		case ProxyTLVSSL:
+			ssl, err := parseProxySSL(value)
+			if err != nil {
+				return err
+			}
+			hdr.SSL = ssl
+
+		case ProxyTLVNetNS:
+			hdr.NetNS = string(value)
+
+		case ProxyTLVAWS:
+			if len(value) != 0 && value[0] == proxyAWSVPCEndpointID {
+				hdr.AWSVPCEndpointID = string(value[1:])
+			}
+		}
+
+		if typ != ProxyTLVNoop {
+			hdr.TLVs = append(hdr.TLVs, ProxyTLV{Type: typ, Value: value})
+		}
+	}
+
+	return nil
+}
+
+func parseProxySSL(b []byte) (*ProxySSL, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("invalid length of the SSL TLV in proxy protocol header: %d", len(b))
+	}
+
+	client := b[0]
+	verify := binary.BigEndian.Uint32(b[1:5])
+
+	ssl := &ProxySSL{
+		Client:   (client & proxyClientSSL) != 0,
+		CertConn: (client & proxyClientCertConn) != 0,
+		CertSess: (client & proxyClientCertSess) != 0,
+	}
+
+	// The verify field is zero when the certificate was verified, it is also
+	// zero when the client didn't present a certificate.
+	ssl.Verified = verify == 0 && (ssl.CertConn || ssl.CertSess)
+
+	for b = b[5:]; len(b) != 0; {
+		if len(b) < 3 {
+			return nil, errors.New("truncated SSL sub-TLV found in proxy protocol header")
+		}
+
+		typ := b[0]
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("SSL sub-TLV of type %#x in proxy protocol header is longer than the TLV: %d > %d", typ, n, len(b)-3)
+		}
+
+		value := string(b[3 : 3+n])
+		b = b[3+n:]
+
+		switch typ {
+		case ProxyTLVSSLVersion:
+			ssl.Version = value
+		case ProxyTLVSSLCN:
+			ssl.CommonName = value
+		case ProxyTLVSSLCipher:
+			ssl.Cipher = value
+		case ProxyTLVSSLSigAlg:
+			ssl.SigAlg = value
+		case ProxyTLVSSLKeyAlg:
+			ssl.KeyAlg = value
+		}
+	}
+
+	return ssl, nil
+}
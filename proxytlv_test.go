@@ -0,0 +1,336 @@
+package netx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// appendTestTLV appends a TLV to the proxy protocol v2 header in b and updates
+// the length of the header.
+func appendTestTLV(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ, byte(len(value)>>8), byte(len(value)))
+	b = append(b, value...)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-16))
+	return b
+}
+
+// appendTestCRC32C appends a checksum TLV to the proxy protocol v2 header in b.
+func appendTestCRC32C(b []byte) []byte {
+	b = appendTestTLV(b, ProxyTLVCRC32C, make([]byte, 4))
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+	return b
+}
+
+func testProxyHeaderV2() []byte {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	ssl := []byte{proxyClientSSL | proxyClientCertConn, 0, 0, 0, 0}
+	ssl = appendTestSubTLV(ssl, ProxyTLVSSLVersion, "TLSv1.3")
+	ssl = appendTestSubTLV(ssl, ProxyTLVSSLCN, "client")
+	ssl = appendTestSubTLV(ssl, ProxyTLVSSLCipher, "TLS_AES_128_GCM_SHA256")
+
+	b := appendProxyProtoV2(nil, src, dst, false)
+	b = appendTestTLV(b, ProxyTLVALPN, []byte("h2"))
+	b = appendTestTLV(b, ProxyTLVAuthority, []byte("example.com"))
+	b = appendTestTLV(b, ProxyTLVUniqueID, []byte("1234"))
+	b = appendTestTLV(b, ProxyTLVSSL, ssl)
+	b = appendTestTLV(b, ProxyTLVNetNS, []byte("blue"))
+	b = appendTestTLV(b, ProxyTLVAWS, []byte("\x01vpce-08d2bf15fac5001c9"))
+	b = appendTestTLV(b, ProxyTLVNoop, make([]byte, 300))
+	return appendTestCRC32C(b)
+}
+
+func appendTestSubTLV(b []byte, typ byte, value string) []byte {
+	b = append(b, typ, byte(len(value)>>8), byte(len(value)))
+	return append(b, value...)
+}
+
+func TestProxyProtoV2TLV(t *testing.T) {
+	b := testProxyHeaderV2()
+	r := &readOneByOne{append(b, "Hello World!"...)}
+
+	hdr, buf, err := parseProxyProto(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rest := string(buf) + string(r.b); rest != "Hello World!" {
+		t.Errorf("bad trailing bytes: %q", rest)
+	}
+
+	if hdr.Version != 2 {
+		t.Error("bad version:", hdr.Version)
+	}
+
+	if hdr.ALPN != "h2" {
+		t.Error("bad ALPN:", hdr.ALPN)
+	}
+
+	if hdr.Authority != "example.com" {
+		t.Error("bad authority:", hdr.Authority)
+	}
+
+	if string(hdr.UniqueID) != "1234" {
+		t.Error("bad unique ID:", hdr.UniqueID)
+	}
+
+	if hdr.NetNS != "blue" {
+		t.Error("bad network namespace:", hdr.NetNS)
+	}
+
+	if hdr.AWSVPCEndpointID != "vpce-08d2bf15fac5001c9" {
+		t.Error("bad VPC endpoint ID:", hdr.AWSVPCEndpointID)
+	}
+
+	ssl := &ProxySSL{
+		Client:     true,
+		CertConn:   true,
+		Verified:   true,
+		Version:    "TLSv1.3",
+		CommonName: "client",
+		Cipher:     "TLS_AES_128_GCM_SHA256",
+	}
+
+	if !reflect.DeepEqual(hdr.SSL, ssl) {
+		t.Errorf("bad SSL information:\n- expected: %#v\n- found:    %#v", ssl, hdr.SSL)
+	}
+
+	var types []byte
+
+	for _, tlv := range hdr.TLVs {
+		types = append(types, tlv.Type)
+	}
+
+	if !bytes.Equal(types, []byte{ProxyTLVALPN, ProxyTLVAuthority, ProxyTLVUniqueID, ProxyTLVSSL, ProxyTLVNetNS, ProxyTLVAWS, ProxyTLVCRC32C}) {
+		t.Errorf("bad list of TLVs: %#v", types)
+	}
+}
+
+func TestProxyProtoV2TLVError(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+	hdr := appendProxyProtoV2(nil, src, dst, false)
+	hdr = hdr[:len(hdr):len(hdr)] // each test appends to a copy
+
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{
+			name: "checksum",
+			header: func() []byte {
+				b := testProxyHeaderV2()
+				b[len(b)-1]++
+				return b
+			}(),
+		},
+		{
+			name: "truncated",
+			header: func() []byte {
+				b := appendTestTLV(hdr, ProxyTLVALPN, []byte("h2"))
+				binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-16-1))
+				return b[:len(b)-1]
+			}(),
+		},
+		{
+			name:   "unique-id",
+			header: appendTestTLV(hdr, ProxyTLVUniqueID, make([]byte, 129)),
+		},
+		{
+			name:   "ssl",
+			header: appendTestTLV(hdr, ProxyTLVSSL, []byte{1, 0, 0}),
+		},
+		{
+			name:   "addresses",
+			header: append(append([]byte{}, signature[:]...), 0x21, 0x11, 0, 4, 127, 0, 0, 1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := parseProxyProto(bytes.NewReader(test.header)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	type result struct {
+		hdr    *ProxyHeader
+		local  string
+		remote string
+		data   string
+	}
+
+	results := make(chan result, 1)
+
+	addr, close := listenAndServe(&ProxyProtocol{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			defer conn.Close()
+			hdr, _ := ProxyHeaderOf(conn)
+			b, _ := ioutil.ReadAll(conn)
+			results <- result{
+				hdr:    hdr,
+				local:  conn.LocalAddr().String(),
+				remote: conn.RemoteAddr().String(),
+				data:   string(b),
+			}
+		}),
+	})
+	defer close()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(testProxyHeaderV2())
+	io.WriteString(conn, strings.Repeat("A", 1000))
+	conn.(*net.TCPConn).CloseWrite()
+
+	res := <-results
+
+	if res.hdr == nil {
+		t.Fatal("no proxy protocol header found on the connection")
+	}
+
+	if res.hdr.AWSVPCEndpointID != "vpce-08d2bf15fac5001c9" {
+		t.Error("bad VPC endpoint ID:", res.hdr.AWSVPCEndpointID)
+	}
+
+	if res.local != "192.0.2.2:443" {
+		t.Error("bad local address:", res.local)
+	}
+
+	if res.remote != "192.0.2.1:56789" {
+		t.Error("bad remote address:", res.remote)
+	}
+
+	if res.data != strings.Repeat("A", 1000) {
+		t.Errorf("bad data received after the header: %d bytes", len(res.data))
+	}
+}
+
+func TestProxyHeaderWriteTo(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	tests := []struct {
+		name string
+		in   ProxyHeader
+		out  ProxyHeader
+	}{
+		{
+			name: "v1",
+			in:   ProxyHeader{Version: 1, SrcAddr: src, DstAddr: dst},
+			out:  ProxyHeader{Version: 1, SrcAddr: src, DstAddr: dst},
+		},
+		{
+			name: "v1-unknown",
+			in:   ProxyHeader{Version: 1, SrcAddr: &net.UnixAddr{Net: "unix", Name: "/tmp/src.sock"}},
+			out:  ProxyHeader{Version: 1},
+		},
+		{
+			name: "v1-mixed-families",
+			in:   ProxyHeader{Version: 1, SrcAddr: src, DstAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443}},
+			out:  ProxyHeader{Version: 1},
+		},
+		{
+			name: "v2-mixed-families",
+			in:   ProxyHeader{Version: 2, SrcAddr: src, DstAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443}},
+			out: ProxyHeader{
+				Version: 2,
+				SrcAddr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 56789},
+				DstAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443},
+			},
+		},
+		{
+			name: "v2-converted-addresses",
+			in: ProxyHeader{
+				Version: 2,
+				SrcAddr: &NetAddr{Net: "udp", Addr: "192.0.2.1:56789"},
+				DstAddr: &NetAddr{Net: "udp", Addr: "192.0.2.2:53"},
+			},
+			out: ProxyHeader{
+				Version: 2,
+				SrcAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56789},
+				DstAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53},
+			},
+		},
+		{
+			name: "v2-tlvs",
+			in: ProxyHeader{
+				Version: 2,
+				SrcAddr: src,
+				DstAddr: dst,
+				TLVs: []ProxyTLV{
+					{Type: ProxyTLVALPN, Value: []byte("h2")},
+					{Type: ProxyTLVCRC32C, Value: make([]byte, 4)},
+					{Type: ProxyTLVUniqueID, Value: []byte("1234")},
+				},
+			},
+			out: ProxyHeader{
+				Version:  2,
+				SrcAddr:  src,
+				DstAddr:  dst,
+				ALPN:     "h2",
+				UniqueID: []byte("1234"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+
+			if _, err := test.in.WriteTo(b); err != nil {
+				t.Fatal(err)
+			}
+
+			hdr, buf, err := parseProxyProto(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(buf) != 0 || b.Len() != 0 {
+				t.Error("unexpected trailing bytes")
+			}
+
+			hdr.TLVs = nil
+
+			if !reflect.DeepEqual(*hdr, test.out) {
+				t.Errorf("bad header:\n- expected: %#v\n- found:    %#v", test.out, *hdr)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderWriteToError(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  ProxyHeader
+	}{
+		{"version", ProxyHeader{Version: 3}},
+		{"v1-tlvs", ProxyHeader{Version: 1, TLVs: []ProxyTLV{{Type: ProxyTLVALPN}}}},
+		{"v2-too-large", ProxyHeader{Version: 2, TLVs: []ProxyTLV{{Type: ProxyTLVNoop, Value: make([]byte, 65535)}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.hdr.WriteTo(ioutil.Discard); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
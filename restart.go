@@ -0,0 +1,393 @@
+package netx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// RestartEnv is the name of the environment variable used to tell a process
+// started by Restart which file descriptor it can receive its listeners from.
+const RestartEnv = "NETX_RESTART_FD"
+
+// Restart starts a new instance of the running program and hands it the
+// listeners in lstns, then waits for the new process to call Ready.
+//
+// The new process runs the same executable with the same arguments and
+// environment. It picks up its listeners by calling Listen with the names they
+// were given in lstns, which makes it convenient to name listeners after the
+// address they were created with, the same configuration then works for the
+// first process and for the ones started by Restart. When a listener is a
+// MultiListener all the listeners it's made of are passed under the same name,
+// and Listen returns a MultiListener in the new process.
+//
+// When the function returns successfully the new process is accepting
+// connections, the program should gracefully shut down its servers (see
+// Server.Shutdown) and exit. The listeners in lstns are left open, they should
+// be closed by the servers using them. Unix domain sockets listeners are
+// modified to not remove their socket file when they are closed.
+//
+// The returned process is already being waited on, the program must not call
+// its Wait method.
+//
+// If ctx expires before the new process calls Ready, or if it exits before
+// that, the new process is killed and an error is returned.
+func Restart(ctx context.Context, lstns map[string]net.Listener) (*os.Process, error) {
+	files, err := restartFiles(lstns)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	fd1, fd2, err := socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	f1 := os.NewFile(uintptr(fd1), "")
+	f2 := os.NewFile(uintptr(fd2), "")
+	defer f2.Close()
+
+	c, err := net.FileConn(f1)
+	f1.Close()
+	if err != nil {
+		return nil, err
+	}
+	socket := c.(*net.UnixConn)
+	defer socket.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f2}
+	cmd.Env = append(restartEnviron(), RestartEnv+"=3")
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready := make(chan error, 1)
+	go func() { ready <- sendRestartFiles(socket, files) }()
+
+	select {
+	case err = <-ready:
+	case err = <-exited:
+		if err == nil {
+			err = errors.New("the new process exited before it was ready")
+		}
+		return nil, err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// Ready must be called by programs started with Restart to signal that they
+// are accepting connections. Inherited listeners that were not picked up by a
+// call to Listen are closed.
+//
+// The function does nothing if the program wasn't started by Restart.
+func Ready() error {
+	inherited.load()
+
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	if inherited.err != nil {
+		return inherited.err
+	}
+
+	if inherited.socket == nil {
+		return nil
+	}
+
+	for name, lstns := range inherited.lstns {
+		for _, l := range lstns {
+			l.Close()
+		}
+		delete(inherited.lstns, name)
+	}
+
+	_, err := inherited.socket.Write([]byte("ready"))
+	inherited.socket.Close()
+	inherited.socket = nil
+	return err
+}
+
+type restartFile struct {
+	name string
+	file *os.File
+}
+
+func restartFiles(lstns map[string]net.Listener) (files []restartFile, err error) {
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				f.file.Close()
+			}
+			files = nil
+		}
+	}()
+
+	for name, lstn := range lstns {
+		if len(name) == 0 {
+			err = errors.New("listeners passed to a new process must have a name")
+			return
+		}
+
+		for _, l := range flattenListeners(lstn) {
+			var f *os.File
+
+			if u, ok := l.(*net.UnixListener); ok {
+				u.SetUnlinkOnClose(false)
+			}
+
+			fl, ok := l.(interface {
+				File() (*os.File, error)
+			})
+			if !ok {
+				err = fmt.Errorf("%s: listeners of type %T cannot be passed to a new process", name, l)
+				return
+			}
+
+			if f, err = fl.File(); err != nil {
+				return
+			}
+
+			files = append(files, restartFile{name: name, file: f})
+		}
+	}
+
+	return
+}
+
+// flattenListeners returns the list of listeners that lstn is made of if it is
+// a compound listener, or a list containing only lstn.
+func flattenListeners(lstn net.Listener) []net.Listener {
+	c, ok := lstn.(interface {
+		Listeners() []net.Listener
+	})
+	if !ok {
+		return []net.Listener{lstn}
+	}
+
+	var list []net.Listener
+
+	for _, l := range c.Listeners() {
+		list = append(list, flattenListeners(l)...)
+	}
+
+	return list
+}
+
+// sendRestartFiles sends files over socket, each message carries the name of a
+// listener and its file descriptor. A last message without file descriptor
+// indicates that all listeners were sent, then the function waits for the
+// new process to notify that it is ready.
+func sendRestartFiles(socket *net.UnixConn, files []restartFile) error {
+	for _, f := range files {
+		// Calling Fd puts the socket in blocking mode, which is shared with the
+		// listener, so we make sure to set it back to non-blocking.
+		fd := int(f.file.Fd())
+		_, _, err := socket.WriteMsgUnix([]byte(f.name), syscall.UnixRights(fd), nil)
+		syscall.SetNonblock(fd, true)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := socket.Write([]byte("\n")); err != nil {
+		return err
+	}
+
+	var b [16]byte
+	n, err := socket.Read(b[:])
+	if err != nil {
+		return err
+	}
+
+	if string(b[:n]) != "ready" {
+		return fmt.Errorf("unexpected message received from the new process: %q", b[:n])
+	}
+
+	return nil
+}
+
+func restartEnviron() []string {
+	env := os.Environ()
+	out := make([]string, 0, len(env)+1)
+
+	for _, e := range env {
+		if !strings.HasPrefix(e, RestartEnv+"=") {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
+// inheritedListeners holds the listeners received from the parent process
+// when the program was started by Restart.
+type inheritedListeners struct {
+	once   sync.Once
+	mutex  sync.Mutex
+	socket *net.UnixConn
+	lstns  map[string][]net.Listener
+	err    error
+}
+
+var inherited inheritedListeners
+
+// load receives the listeners from the parent process the first time it is
+// called, the environment variable is removed so processes started by the
+// program don't attempt to use it.
+func (i *inheritedListeners) load() {
+	i.once.Do(func() {
+		env := os.Getenv(RestartEnv)
+		if len(env) == 0 {
+			return
+		}
+		os.Unsetenv(RestartEnv)
+
+		fd, err := strconv.Atoi(env)
+		if err != nil || fd < 0 {
+			i.err = fmt.Errorf("invalid file descriptor in %s: %q", RestartEnv, env)
+			return
+		}
+
+		f := os.NewFile(uintptr(fd), "")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			i.err = err
+			return
+		}
+
+		socket, ok := c.(*net.UnixConn)
+		if !ok {
+			c.Close()
+			i.err = fmt.Errorf("the file descriptor in %s is not a unix domain socket", RestartEnv)
+			return
+		}
+
+		i.socket = socket
+		i.lstns, i.err = recvRestartFiles(socket)
+	})
+}
+
+// take removes the listener registered under name and returns it.
+func (i *inheritedListeners) take(name string) (lstn net.Listener, ok bool, err error) {
+	i.load()
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if err = i.err; err != nil {
+		return
+	}
+
+	var lstns []net.Listener
+
+	if lstns, ok = i.lstns[name]; !ok {
+		return
+	}
+	delete(i.lstns, name)
+
+	if len(lstns) == 1 {
+		lstn = lstns[0]
+	} else {
+		lstn = MultiListener(lstns...)
+	}
+
+	return
+}
+
+func recvRestartFiles(socket *net.UnixConn) (lstns map[string][]net.Listener, err error) {
+	var b = make([]byte, 4096)
+	var oob = make([]byte, syscall.CmsgSpace(4))
+
+	lstns = make(map[string][]net.Listener)
+
+	defer func() {
+		if err != nil {
+			for _, list := range lstns {
+				for _, l := range list {
+					l.Close()
+				}
+			}
+			lstns = nil
+		}
+	}()
+
+	for {
+		var n, oobn int
+		var msg []syscall.SocketControlMessage
+		var fds []int
+		var lstn net.Listener
+
+		if n, oobn, _, _, err = socket.ReadMsgUnix(b, oob); err != nil {
+			return
+		}
+
+		if oobn == 0 { // end of the list of listeners
+			return
+		}
+
+		if msg, err = syscall.ParseSocketControlMessage(oob[:oobn]); err != nil {
+			err = os.NewSyscallError("ParseSocketControlMessage", err)
+			return
+		}
+
+		if len(msg) != 1 {
+			err = fmt.Errorf("invalid number of socket control messages, expected 1 but found %d", len(msg))
+			return
+		}
+
+		if fds, err = syscall.ParseUnixRights(&msg[0]); err != nil {
+			err = os.NewSyscallError("ParseUnixRights", err)
+			return
+		}
+
+		name := string(b[:n])
+		f := os.NewFile(uintptr(fds[0]), name)
+		lstn, err = net.FileListener(f)
+		f.Close()
+
+		for _, fd := range fds[1:] {
+			syscall.Close(fd)
+		}
+
+		if err != nil {
+			return
+		}
+
+		lstns[name] = append(lstns[name], lstn)
+	}
+}
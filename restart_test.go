@@ -0,0 +1,85 @@
+package netx
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// The test binary is started again by TestRestart, in which case it acts as the
+// new process, serving a single connection on the listener it inherited.
+func init() {
+	if os.Getenv("NETX_TEST_RESTART") == "" {
+		return
+	}
+
+	lstn, err := Listen("test")
+	if err != nil {
+		panic(err)
+	}
+
+	if os.Getenv(RestartEnv) != "" {
+		panic("the restart environment variable was not removed")
+	}
+
+	if err := Ready(); err != nil {
+		panic(err)
+	}
+
+	conn, err := lstn.Accept()
+	if err != nil {
+		panic(err)
+	}
+	io.WriteString(conn, "Hello from the new process!")
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestRestart(t *testing.T) {
+	lstn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	os.Setenv("NETX_TEST_RESTART", "1")
+	defer os.Unsetenv("NETX_TEST_RESTART")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := Restart(ctx, map[string]net.Listener{"test": lstn}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the listener must not prevent the new process from accepting
+	// connections on the same socket.
+	lstn.Close()
+
+	conn, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if s := string(b); s != "Hello from the new process!" {
+		t.Errorf("bad response: %q", s)
+	}
+}
+
+func TestReadyWithoutRestart(t *testing.T) {
+	if err := Ready(); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,10 +2,11 @@ package netx
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"runtime"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -35,6 +36,81 @@ type Server struct {
 	Handler  Handler         // handler to invoke on new connections
 	ErrorLog *log.Logger     // the logger used to output internal errors
 	Context  context.Context // the base context used by the server
+
+	// Logger receives the events reported by the server. If nil, the events
+	// are output to ErrorLog.
+	Logger Logger
+
+	// PanicHandler is called when the handler panics while serving conn, it
+	// receives the recovered value and the stack trace of the goroutine that
+	// panicked. The function may panic again to crash the program.
+	// If nil, the panic is reported to the server's logger.
+	//
+	// Panics with a value of type *UnrecoverablePanic are not passed to the
+	// PanicHandler, the server raises them again to crash the program.
+	PanicHandler func(conn net.Conn, err interface{}, stack []byte)
+
+	// ConnState specifies an optional callback function that is called when a
+	// client connection changes state. See the ConnState type and associated
+	// constants for details.
+	ConnState func(net.Conn, ConnState)
+
+	// MaxConns is the maximum number of connections that the server handles
+	// concurrently. Zero means no limit.
+	MaxConns int
+
+	// OverloadPolicy configures how the server behaves when it has reached
+	// MaxConns.
+	OverloadPolicy OverloadPolicy
+
+	// Overloaded is the handler invoked on connections accepted while the
+	// server had reached MaxConns, when OverloadPolicy is OverloadHandle. It is
+	// expected to write a protocol-specific rejection and return quickly.
+	// If nil, the connections are closed.
+	Overloaded Handler
+
+	// Limiter is an optional limiter applied to connections before they are
+	// passed to the handler. Connections rejected by the limiter are closed
+	// right away.
+	Limiter *SourceLimiter
+
+	mutex   sync.Mutex
+	stats   ServerStats
+	slots   chan struct{}            // semaphore limiting the number of connections
+	conns   map[*serverConn]struct{} // connections currently being served
+	cancels map[*context.CancelFunc]struct{}
+	pauses  map[*time.Time]struct{} // start times of the pauses in progress
+	drained chan struct{}           // closed when the last connection is untracked
+	killed  chan struct{}           // closed when Shutdown force-closes connections
+	closing bool                    // set when Shutdown is called
+}
+
+// An OverloadPolicy defines what a Server does with new connections when it has
+// reached its maximum number of concurrent connections.
+type OverloadPolicy int
+
+const (
+	// OverloadPause stops accepting connections until one of the connections
+	// being served is closed, letting the kernel queue new connections in the
+	// listener's backlog.
+	OverloadPause OverloadPolicy = iota
+
+	// OverloadClose accepts new connections and immediately closes them.
+	OverloadClose
+
+	// OverloadHandle accepts new connections and passes them to the server's
+	// Overloaded handler.
+	OverloadHandle
+)
+
+// ServerStats is a snapshot of the counters maintained by a Server.
+type ServerStats struct {
+	Conns      int           // number of connections currently being served
+	Accepted   uint64        // number of connections accepted
+	Overloaded uint64        // number of connections accepted while the server was at MaxConns
+	Paused     time.Duration // time spent not accepting because the server was at MaxConns, including the pauses in progress
+	Pausing    bool          // true if the server is not accepting right now because it is at MaxConns
+	Rejected   uint64        // number of connections rejected by the server's limiter
 }
 
 // ListenAndServe listens on the server address and then call Serve to handle
@@ -59,7 +135,7 @@ func (s *Server) Serve(lstn net.Listener) error {
 	defer lstn.Close()
 
 	join := &sync.WaitGroup{}
-	defer join.Wait()
+	defer s.wait(join)
 
 	ctx := s.Context
 	if ctx == nil {
@@ -69,12 +145,20 @@ func (s *Server) Serve(lstn net.Listener) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	defer s.trackCancel(&cancel)()
+
 	done := ctx.Done()
 	errs := make(chan error)
 	conns := make(chan net.Conn)
+	slots := s.limit()
+	pause := slots != nil && s.OverloadPolicy == OverloadPause
 
 	join.Add(1)
-	go s.accept(ctx, lstn, conns, errs, join)
+	if pause {
+		go s.accept(ctx, lstn, conns, errs, slots, join)
+	} else {
+		go s.accept(ctx, lstn, conns, errs, nil, join)
+	}
 
 	for conns != nil || errs != nil {
 		select {
@@ -94,15 +178,58 @@ func (s *Server) Serve(lstn net.Listener) error {
 				conns = nil
 				continue
 			}
+			c := newServerConn(s, conn)
+			handler := s.Handler
+
+			if pause {
+				// The slot was acquired by the accept goroutine, it must be
+				// released if the connection is rejected.
+				c.slots = slots
+			}
+
+			if limiter := s.Limiter; limiter != nil {
+				if !limiter.Acquire(conn.RemoteAddr()) {
+					s.rejected()
+					c.release()
+					reject(conn)
+					continue
+				}
+				c.limiter = limiter
+			}
+
+			switch {
+			case slots == nil, pause:
+			case tryAcquire(slots):
+				c.slots = slots
+			default:
+				if handler = s.Overloaded; handler == nil || s.OverloadPolicy != OverloadHandle {
+					s.overloaded(true)
+					c.release()
+					conn.Close()
+					continue
+				}
+				s.overloaded(false)
+			}
+
+			if !s.trackConn(c) {
+				// The server is shutting down, the connection was accepted
+				// too late to be served.
+				c.release()
+				conn.Close()
+				continue
+			}
+			if hook := s.ConnState; hook != nil {
+				hook(c, StateNew)
+			}
 			join.Add(1)
-			go s.serve(ctx, conn, join)
+			go s.serve(ctx, c, handler, join)
 		}
 	}
 
 	return nil
 }
 
-func (s *Server) accept(ctx context.Context, lstn net.Listener, conns chan<- net.Conn, errs chan<- error, join *sync.WaitGroup) {
+func (s *Server) accept(ctx context.Context, lstn net.Listener, conns chan<- net.Conn, errs chan<- error, slots chan struct{}, join *sync.WaitGroup) {
 	defer join.Done()
 	defer close(errs)
 	defer close(conns)
@@ -112,6 +239,13 @@ func (s *Server) accept(ctx context.Context, lstn net.Listener, conns chan<- net
 		var conn net.Conn
 		var err error
 
+		// When the server has a limit on the number of connections and the
+		// overload policy is OverloadPause, wait for a slot to be available
+		// before accepting a new connection.
+		if slots != nil && !s.acquire(ctx, slots) {
+			return
+		}
+
 		for attempt := 0; true; attempt++ {
 			if conn, err = lstn.Accept(); err == nil {
 				break
@@ -127,10 +261,20 @@ func (s *Server) accept(ctx context.Context, lstn net.Listener, conns chan<- net
 			if backoff > maxBackoff {
 				backoff = maxBackoff
 			}
-			s.logf("Accept error: %v; retrying in %v", err, backoff)
+			s.logger().Log(Event{
+				Type:      EventAcceptError,
+				LocalAddr: lstn.Addr(),
+				Error:     err,
+				ErrorKind: errorKind(err),
+				Attempt:   attempt,
+				Backoff:   backoff,
+			})
 			select {
 			case <-time.After(backoff):
 			case <-ctx.Done():
+				if slots != nil {
+					<-slots
+				}
 				return
 			}
 		}
@@ -143,6 +287,9 @@ func (s *Server) accept(ctx context.Context, lstn net.Listener, conns chan<- net
 					err = nil
 				}
 			}
+			if slots != nil {
+				<-slots
+			}
 			if err != nil {
 				select {
 				case <-ctx.Done():
@@ -159,41 +306,335 @@ func (s *Server) accept(ctx context.Context, lstn net.Listener, conns chan<- net
 	}
 }
 
-func (s *Server) serve(ctx context.Context, conn net.Conn, join *sync.WaitGroup) {
-	defer func() { Recover(recover(), conn, s.ErrorLog) }()
+// limit returns the semaphore used to limit the number of concurrent
+// connections, or nil if the server has no limit.
+func (s *Server) limit() chan struct{} {
+	if s.MaxConns <= 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.slots == nil {
+		s.slots = make(chan struct{}, s.MaxConns)
+	}
+
+	return s.slots
+}
+
+// acquire blocks until a slot is available, recording the time it had to wait
+// when there was none. The method returns false if ctx was canceled.
+func (s *Server) acquire(ctx context.Context, slots chan struct{}) bool {
+	if tryAcquire(slots) {
+		return true
+	}
+
+	start := time.Now()
 
+	s.mutex.Lock()
+	if s.pauses == nil {
+		s.pauses = make(map[*time.Time]struct{})
+	}
+	s.pauses[&start] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pauses, &start)
+		s.stats.Paused += time.Since(start)
+		s.mutex.Unlock()
+	}()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func tryAcquire(slots chan struct{}) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// overloaded counts a connection accepted while the server was at MaxConns,
+// closed is true if the connection won't be tracked because it was closed
+// right away.
+func (s *Server) overloaded(closed bool) {
+	s.mutex.Lock()
+	if closed {
+		s.stats.Accepted++
+	}
+	s.stats.Overloaded++
+	s.mutex.Unlock()
+}
+
+func (s *Server) rejected() {
+	s.mutex.Lock()
+	s.stats.Accepted++
+	s.stats.Rejected++
+	s.mutex.Unlock()
+}
+
+// reject closes conn, avoiding to keep the socket in TIME_WAIT state when it
+// is a TCP connection.
+func reject(conn net.Conn) {
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (s *Server) serve(ctx context.Context, conn *serverConn, handler Handler, join *sync.WaitGroup) {
 	defer join.Done()
-	defer conn.Close()
+	defer conn.release()
+	defer s.untrackConn(conn)
+	defer conn.setState(StateClosed)
+	defer conn.closeUnlessHijacked()
+
+	// Recover before closing the connection so the panic handler can still use
+	// it to report the error to the client.
+	defer func() { s.recover(recover(), conn) }()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	s.Handler.ServeConn(ctx, conn)
+	conn.setState(StateActive)
+	handler.ServeConn(ctx, conn)
 }
 
-func (s *Server) logf(format string, args ...interface{}) {
-	logf(s.ErrorLog)(format, args...)
+// Stats returns a snapshot of the server's counters.
+func (s *Server) Stats() ServerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := s.stats
+	stats.Conns = len(s.conns)
+	stats.Pausing = len(s.pauses) != 0
+
+	for start := range s.pauses {
+		stats.Paused += time.Since(*start)
+	}
+
+	return stats
 }
 
-// Recover is intended to be used by servers that gracefully handle panics from
-// their handlers.
-func Recover(err interface{}, conn net.Conn, logger *log.Logger) {
+// Conns returns a snapshot of the connections currently served by s.
+func (s *Server) Conns() []ConnInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conns := make([]ConnInfo, 0, len(s.conns))
+
+	for conn := range s.conns {
+		conns = append(conns, conn.info())
+	}
+
+	return conns
+}
+
+// Shutdown gracefully stops the server. It closes the listeners, cancels the
+// contexts passed to the handlers and waits for the in-flight connections to
+// be closed. Hijacked connections are not waited for.
+//
+// If ctx expires before all connections were closed the remaining ones are
+// forcibly closed, the method then returns the number of connections that were
+// cut off, and the context's error. Calls to Serve return without waiting on
+// the handlers that still haven't returned at this point.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mutex.Lock()
+	s.closing = true
+
+	for cancel := range s.cancels {
+		(*cancel)()
+	}
+
+	var drained <-chan struct{}
+	if len(s.conns) != 0 {
+		if s.drained == nil {
+			s.drained = make(chan struct{})
+		}
+		drained = s.drained
+	}
+	s.mutex.Unlock()
+
+	if drained == nil {
+		return 0, nil
+	}
+
+	select {
+	case <-drained:
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := len(s.conns)
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	if s.killed == nil {
+		s.killed = make(chan struct{})
+	}
+
+	select {
+	case <-s.killed:
+	default:
+		close(s.killed)
+	}
+
+	return n, ctx.Err()
+}
+
+// wait blocks until join is done, or until a call to Shutdown forced the
+// connections to close.
+func (s *Server) wait(join *sync.WaitGroup) {
+	done := make(chan struct{})
+
+	go func() {
+		join.Wait()
+		close(done)
+	}()
+
+	s.mutex.Lock()
+	if s.killed == nil {
+		s.killed = make(chan struct{})
+	}
+	killed := s.killed
+	s.mutex.Unlock()
+
+	select {
+	case <-done:
+	case <-killed:
+	}
+}
+
+func (s *Server) trackCancel(cancel *context.CancelFunc) (untrack func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closing {
+		(*cancel)()
+	}
+
+	if s.cancels == nil {
+		s.cancels = make(map[*context.CancelFunc]struct{})
+	}
+
+	s.cancels[cancel] = struct{}{}
+
+	return func() {
+		s.mutex.Lock()
+		delete(s.cancels, cancel)
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Server) trackConn(conn *serverConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats.Accepted++
+
+	if s.closing {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn *serverConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.conns, conn)
+
+	if len(s.conns) == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+func (s *Server) recover(err interface{}, conn net.Conn) {
 	if err == nil {
 		return
 	}
+	if p, ok := err.(*UnrecoverablePanic); ok {
+		panic(p)
+	}
+	if s.PanicHandler == nil {
+		RecoverLogger(err, conn, s.logger())
+		return
+	}
+	s.PanicHandler(conn, err, debug.Stack())
+}
+
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return NewLogger(s.ErrorLog)
+}
+
+// UnrecoverablePanic is the type of values that nested servers panic with when
+// their panic handler panicked again, asking for the program to crash. Servers
+// that recover panics from their handlers must raise these values again instead
+// of handling them, Recover and RecoverLogger do it automatically.
+type UnrecoverablePanic struct {
+	// Value is the value that the panic handler panicked with.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine where the panic handler
+	// panicked, which is lost when the panic is recovered by the outer servers.
+	Stack []byte
+}
 
-	logf := logf(logger)
-	laddr := conn.LocalAddr()
-	raddr := conn.RemoteAddr()
+// Error satisfies the error interface.
+func (p *UnrecoverablePanic) Error() string {
+	return fmt.Sprintf("%v\n\n%s", p.Value, p.Stack)
+}
 
-	buf := make([]byte, 262144)
-	buf = buf[:runtime.Stack(buf, false)]
-	logf("panic serving %s->%s: %v\n%s", laddr, raddr, err, string(buf))
+// Recover is intended to be used by servers that gracefully handle panics from
+// their handlers.
+//
+// The function panics again if err is of type *UnrecoverablePanic.
+func Recover(err interface{}, conn net.Conn, logger *log.Logger) {
+	RecoverLogger(err, conn, NewLogger(logger))
 }
 
-func logf(logger *log.Logger) func(string, ...interface{}) {
-	if logger == nil {
-		return log.Printf
+// RecoverLogger is like Recover but reports the panic as an EventPanic to a
+// Logger.
+func RecoverLogger(err interface{}, conn net.Conn, logger Logger) {
+	if err == nil {
+		return
 	}
-	return logger.Printf
+	if p, ok := err.(*UnrecoverablePanic); ok {
+		panic(p)
+	}
+
+	e, _ := err.(error)
+	logger.Log(Event{
+		Type:       EventPanic,
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+		Error:      e,
+		ErrorKind:  errorKind(e),
+		Panic:      err,
+		Stack:      debug.Stack(),
+	})
 }
@@ -3,6 +3,7 @@ package netx
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -109,24 +110,246 @@ func TestEchoServer(t *testing.T) {
 	}
 }
 
+func TestServerShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler Handler
+		closed  int
+		err     error
+	}{
+		{
+			name: "graceful",
+			handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+				<-ctx.Done()
+			}),
+			closed: 0,
+			err:    nil,
+		},
+		{
+			name: "forced",
+			handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+				select {} // ignores cancellations
+			}),
+			closed: 1,
+			err:    context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lstn, err := Listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := &Server{Handler: test.handler}
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(lstn) }()
+
+			conn, err := net.Dial("tcp", lstn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// Give a bit of time to the server to accept the connection.
+			time.Sleep(50 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			closed, err := server.Shutdown(ctx)
+
+			if closed != test.closed {
+				t.Error("bad number of closed connections:", closed)
+			}
+
+			if err != test.err {
+				t.Error("bad error:", err)
+			}
+
+			select {
+			case err := <-served:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(1 * time.Second):
+				t.Error("Serve did not return after Shutdown")
+			}
+		})
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy OverloadPolicy
+		output string
+	}{
+		{
+			name:   "pause",
+			policy: OverloadPause,
+			output: "Hello World!",
+		},
+		{
+			name:   "close",
+			policy: OverloadClose,
+			output: "",
+		},
+		{
+			name:   "handle",
+			policy: OverloadHandle,
+			output: "busy\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lstn, err := Listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			server := &Server{
+				Handler:        Echo,
+				Context:        ctx,
+				MaxConns:       1,
+				OverloadPolicy: test.policy,
+				Overloaded: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+					io.WriteString(conn, "busy\n")
+				}),
+			}
+			go server.Serve(lstn)
+
+			c1, err := net.Dial("tcp", lstn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c1.Close()
+
+			// Give a bit of time to the server to accept the first connection.
+			time.Sleep(50 * time.Millisecond)
+
+			c2, err := net.Dial("tcp", lstn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c2.Close()
+
+			time.Sleep(50 * time.Millisecond)
+
+			if test.policy == OverloadPause {
+				// The pause in progress must be visible before it ends.
+				if stats := server.Stats(); !stats.Pausing || stats.Paused == 0 {
+					t.Error("the server does not report the pause in progress:", stats.Pausing, stats.Paused)
+				}
+				if _, err := io.WriteString(c2, "Hello World!"); err != nil {
+					t.Fatal(err)
+				}
+				c1.Close()
+			}
+
+			// The overloaded connections are expected to be closed by the
+			// server, the paused one would be echoing forever.
+			r := io.Reader(c2)
+			if test.policy == OverloadPause {
+				r = io.LimitReader(r, int64(len(test.output)))
+			}
+
+			c2.SetReadDeadline(time.Now().Add(1 * time.Second))
+			b, err := ioutil.ReadAll(r)
+
+			if err != nil {
+				t.Error(err)
+			}
+
+			if s := string(b); s != test.output {
+				t.Errorf("bad output: %q", s)
+			}
+
+			stats := server.Stats()
+
+			if stats.Accepted != 2 {
+				t.Error("bad number of accepted connections:", stats.Accepted)
+			}
+
+			switch test.policy {
+			case OverloadPause:
+				if stats.Overloaded != 0 {
+					t.Error("bad number of overloaded connections:", stats.Overloaded)
+				}
+				if stats.Paused == 0 {
+					t.Error("the server did not pause accepting connections")
+				}
+			default:
+				if stats.Overloaded != 1 {
+					t.Error("bad number of overloaded connections:", stats.Overloaded)
+				}
+			}
+		})
+	}
+}
+
+func TestServerPanicHandler(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	addr, close := listenAndServeWith(&Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			panic("oops")
+		}),
+		PanicHandler: func(conn net.Conn, err interface{}, stack []byte) {
+			io.WriteString(conn, "internal error\n")
+			panics <- err
+		},
+	})
+	defer close()
+
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if s := string(b); s != "internal error\n" {
+		t.Errorf("bad output: %q", s)
+	}
+
+	if err := <-panics; err != "oops" {
+		t.Error("bad recovered value:", err)
+	}
+}
+
 func listenAndServe(h Handler) (addr net.Addr, close func()) {
+	return listenAndServeWith(&Server{
+		Handler:  h,
+		ErrorLog: log.New(os.Stderr, "listen: ", 0),
+	})
+}
+
+func listenAndServeWith(server *Server) (addr net.Addr, close func()) {
 	lstn, err := Listen("127.0.0.1:0")
 	if err != nil {
 		panic(err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	server.Context = ctx
 
 	join := &sync.WaitGroup{}
 	join.Add(1)
 
 	go func() {
 		defer join.Done()
-		(&Server{
-			Handler:  h,
-			Context:  ctx,
-			ErrorLog: log.New(os.Stderr, "listen: ", 0),
-		}).Serve(lstn)
+		server.Serve(lstn)
 	}()
 
 	addr, close = lstn.Addr(), func() {
@@ -135,3 +358,19 @@ func listenAndServe(h Handler) (addr net.Addr, close func()) {
 	}
 	return
 }
+
+func TestServerRecoverUnrecoverablePanic(t *testing.T) {
+	server := &Server{
+		PanicHandler: func(conn net.Conn, err interface{}, stack []byte) {
+			t.Error("the panic handler was called with an unrecoverable panic")
+		},
+	}
+
+	defer func() {
+		if p, ok := recover().(*UnrecoverablePanic); !ok || p.Value != "oops" {
+			t.Error("the unrecoverable panic was not raised again:", p)
+		}
+	}()
+
+	server.recover(&UnrecoverablePanic{Value: "oops"}, nil)
+}
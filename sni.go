@@ -0,0 +1,435 @@
+package netx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSRouter is a connection handler which routes TLS connections based on the
+// server name that clients send in their hello message, without terminating
+// TLS.
+//
+// The router reads the client hello from the connection, then passes it to the
+// handler registered for the server name. The bytes read by the router are
+// replayed to the handler, which sees the connection as if nothing had been
+// read from it, so it may terminate TLS itself or forward the connection as-is
+// to a backend (for example with a Tunnel using TunnelRaw).
+//
+// Patterns are either exact host names like "example.com", wildcards like
+// "*.example.com" which match all the subdomains of "example.com", or "*"
+// which registers the default route. Matching is case insensitive, the exact
+// name is tried first, then wildcards from the most to the least specific, then
+// the default route. The default route also receives connections where the
+// client did not send a server name.
+//
+// The zero-value is a router with no routes, which is ready to use.
+type TLSRouter struct {
+	// Timeout is the maximum amount of time that the router waits for the
+	// client hello message, it defaults to 10 seconds.
+	Timeout time.Duration
+
+	mutex  sync.RWMutex
+	routes map[string]Handler
+}
+
+// Handle registers handler for connections with a server name matching
+// pattern.
+//
+// The method panics if pattern was already registered.
+func (r *TLSRouter) Handle(pattern string, handler Handler) {
+	pattern = strings.ToLower(pattern)
+
+	if handler == nil {
+		panic("netx.TLSRouter: nil handler for " + pattern)
+	}
+
+	if len(pattern) == 0 || (strings.Contains(pattern, "*") && pattern != "*" && (!strings.HasPrefix(pattern, "*.") || strings.Count(pattern, "*") != 1)) {
+		panic("netx.TLSRouter: invalid pattern " + pattern)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.routes[pattern]; exists {
+		panic("netx.TLSRouter: multiple registrations for " + pattern)
+	}
+
+	if r.routes == nil {
+		r.routes = make(map[string]Handler)
+	}
+
+	r.routes[pattern] = handler
+}
+
+// HandleProxy registers a proxy handler for connections with a server name
+// matching pattern.
+//
+// The target address passed to the proxy handler is made of the server name
+// sent by the client and the port that the connection was received on, which
+// combined with a Tunnel makes an SNI proxy to the hosts that the clients
+// intend to reach. Connections without a server name are proxied to the local
+// address of the connection. To forward connections to a fixed address, use
+// Handle with a Proxy instead.
+//
+// The server name is chosen by the client, registering a proxy handler for
+// the "*" pattern turns the router into an open relay that forwards
+// connections to any host reachable from the server. Exact names or wildcard
+// patterns like "*.example.com" should be used to restrict the set of hosts
+// that connections can be forwarded to.
+func (r *TLSRouter) HandleProxy(pattern string, handler ProxyHandler) {
+	if handler == nil {
+		panic("netx.TLSRouter: nil proxy handler for " + pattern)
+	}
+
+	r.Handle(pattern, HandlerFunc(func(ctx context.Context, conn net.Conn) {
+		target := conn.LocalAddr()
+
+		if hello, ok := TLSClientHelloOf(conn); ok && len(hello.ServerName) != 0 {
+			_, port, _ := net.SplitHostPort(target.String())
+			target = &NetAddr{
+				Net:  target.Network(),
+				Addr: net.JoinHostPort(hello.ServerName, port),
+			}
+		}
+
+		handler.ServeProxy(ctx, conn, target)
+	}))
+}
+
+// Handler returns the handler that connections with serverName are routed to,
+// or nil if there are none.
+func (r *TLSRouter) Handler(serverName string) Handler {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(name) != 0 {
+		if h := r.routes[name]; h != nil {
+			return h
+		}
+
+		for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+			name = name[i+1:]
+
+			if h := r.routes["*."+name]; h != nil {
+				return h
+			}
+		}
+	}
+
+	return r.routes["*"]
+}
+
+// ServeConn satisfies the Handler interface.
+//
+// The method panics to report errors.
+func (r *TLSRouter) ServeConn(ctx context.Context, conn net.Conn) {
+	timeout := r.Timeout
+
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, buf, err := readTLSClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		fatal(conn, err)
+	}
+
+	handler := r.Handler(hello.ServerName)
+
+	if handler == nil {
+		fatal(conn, fmt.Errorf("no route for the TLS server name %q", hello.ServerName))
+	}
+
+	handler.ServeConn(ctx, &tlsHelloConn{
+		replayConn: replayConn{Conn: conn, buf: buf},
+		hello:      hello,
+	})
+}
+
+// TLSClientHello carries the information read by a TLSRouter from the hello
+// message that a client sent to initiate a TLS connection.
+type TLSClientHello struct {
+	// ServerName is the value of the server name indication extension, it is
+	// empty if the client did not send one.
+	ServerName string
+
+	// Protocols is the list of application protocols advertised by the client
+	// in the ALPN extension, in the order of preference of the client.
+	Protocols []string
+}
+
+// TLSClientHelloOf returns the client hello that a TLSRouter read from conn, or
+// false if conn wasn't passed to a handler by a TLSRouter. Handlers may call it
+// on wrappers of the connection that they received, as long as BaseConn can
+// unwrap them.
+func TLSClientHelloOf(conn net.Conn) (TLSClientHello, bool) {
+	if c, ok := findConn(conn, isTLSHelloConn).(*tlsHelloConn); ok {
+		return c.hello, true
+	}
+	return TLSClientHello{}, false
+}
+
+func isTLSHelloConn(conn net.Conn) bool {
+	_, ok := conn.(*tlsHelloConn)
+	return ok
+}
+
+type tlsHelloConn struct {
+	replayConn
+	hello TLSClientHello
+}
+
+const (
+	tlsRecordTypeHandshake      = 22
+	tlsHandshakeTypeClientHello = 1
+	tlsExtensionServerName      = 0
+	tlsExtensionALPN            = 16
+
+	// Client hello messages rarely span more than one record, the limit is
+	// there to prevent clients from making the router buffer arbitrary
+	// amounts of data.
+	maxTLSClientHelloSize = 65536
+)
+
+var errNotTLSClientHello = errors.New("the connection did not start with a TLS client hello")
+
+// readTLSClientHello reads records from r until it got a complete client hello
+// message, it returns the parsed message and all the bytes that were read.
+func readTLSClientHello(r io.Reader) (hello TLSClientHello, buf []byte, err error) {
+	var msg []byte
+
+	for {
+		var hdr [5]byte
+
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && len(buf) != 0) {
+				err = errNotTLSClientHello
+			}
+			return
+		}
+
+		if hdr[0] != tlsRecordTypeHandshake || hdr[1] != 3 {
+			err = errNotTLSClientHello
+			return
+		}
+
+		n := int(binary.BigEndian.Uint16(hdr[3:]))
+
+		if n == 0 || len(buf)+len(hdr)+n > maxTLSClientHelloSize {
+			err = errNotTLSClientHello
+			return
+		}
+
+		off := len(buf)
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, make([]byte, n)...)
+
+		if _, err = io.ReadFull(r, buf[off+len(hdr):]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errNotTLSClientHello
+			}
+			return
+		}
+
+		msg = append(msg, buf[off+len(hdr):]...)
+
+		if len(msg) >= 4 {
+			if msg[0] != tlsHandshakeTypeClientHello {
+				err = errNotTLSClientHello
+				return
+			}
+
+			size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+
+			if size > maxTLSClientHelloSize {
+				err = errNotTLSClientHello
+				return
+			}
+
+			if len(msg) >= size {
+				hello, err = parseTLSClientHello(msg[4:size])
+				return
+			}
+		}
+	}
+}
+
+// parseTLSClientHello parses the body of a client hello message, see
+// https://tools.ietf.org/html/rfc5246#section-7.4.1.2
+func parseTLSClientHello(b []byte) (hello TLSClientHello, err error) {
+	var exts []byte
+	var ok bool
+
+	p := tlsParser(b)
+
+	if !p.skip(2+32) || // version and random
+		!p.skipVector(1) || // session id
+		!p.skipVector(2) || // cipher suites
+		!p.skipVector(1) { // compression methods
+		err = errNotTLSClientHello
+		return
+	}
+
+	if len(p) == 0 { // no extensions
+		return
+	}
+
+	if exts, ok = p.vector(2); !ok || len(p) != 0 {
+		err = errNotTLSClientHello
+		return
+	}
+
+	for e := tlsParser(exts); len(e) != 0; {
+		var typ uint16
+		var data []byte
+
+		if typ, ok = e.uint16(); !ok {
+			err = errNotTLSClientHello
+			return
+		}
+
+		if data, ok = e.vector(2); !ok {
+			err = errNotTLSClientHello
+			return
+		}
+
+		switch typ {
+		case tlsExtensionServerName:
+			if hello.ServerName, ok = parseTLSServerName(data); !ok {
+				err = errors.New("malformed server name extension in TLS client hello")
+				return
+			}
+
+		case tlsExtensionALPN:
+			if hello.Protocols, ok = parseTLSProtocols(data); !ok {
+				err = errors.New("malformed ALPN extension in TLS client hello")
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// parseTLSServerName parses the server name extension, see
+// https://tools.ietf.org/html/rfc6066#section-3
+func parseTLSServerName(b []byte) (name string, ok bool) {
+	p := tlsParser(b)
+
+	list, ok := p.vector(2)
+	if !ok || len(p) != 0 {
+		return "", false
+	}
+
+	for l := tlsParser(list); len(l) != 0; {
+		var typ byte
+		var host []byte
+
+		if typ, ok = l.uint8(); !ok {
+			return "", false
+		}
+
+		if host, ok = l.vector(2); !ok {
+			return "", false
+		}
+
+		if typ == 0 && len(name) == 0 { // host_name
+			name = strings.TrimSuffix(string(host), ".")
+		}
+	}
+
+	return name, true
+}
+
+// parseTLSProtocols parses the application layer protocol negotiation
+// extension, see https://tools.ietf.org/html/rfc7301#section-3.1
+func parseTLSProtocols(b []byte) (protos []string, ok bool) {
+	p := tlsParser(b)
+
+	list, ok := p.vector(2)
+	if !ok || len(p) != 0 {
+		return nil, false
+	}
+
+	for l := tlsParser(list); len(l) != 0; {
+		var proto []byte
+
+		if proto, ok = l.vector(1); !ok || len(proto) == 0 {
+			return nil, false
+		}
+
+		protos = append(protos, string(proto))
+	}
+
+	return protos, true
+}
+
+// tlsParser is a helper type to decode the fields of TLS messages, each method
+// consumes bytes from the front of the slice and returns false if there were
+// not enough bytes left.
+type tlsParser []byte
+
+func (p *tlsParser) skip(n int) bool {
+	if len(*p) < n {
+		return false
+	}
+	*p = (*p)[n:]
+	return true
+}
+
+func (p *tlsParser) uint8() (byte, bool) {
+	if len(*p) < 1 {
+		return 0, false
+	}
+	v := (*p)[0]
+	*p = (*p)[1:]
+	return v, true
+}
+
+func (p *tlsParser) uint16() (uint16, bool) {
+	if len(*p) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*p)
+	*p = (*p)[2:]
+	return v, true
+}
+
+// vector consumes a variable-length vector which has its length encoded on
+// size bytes (1 or 2).
+func (p *tlsParser) vector(size int) ([]byte, bool) {
+	if len(*p) < size {
+		return nil, false
+	}
+
+	n := int((*p)[0])
+
+	if size == 2 {
+		n = n<<8 | int((*p)[1])
+	}
+
+	if len(*p) < size+n {
+		return nil, false
+	}
+
+	v := (*p)[size : size+n]
+	*p = (*p)[size+n:]
+	return v, true
+}
+
+func (p *tlsParser) skipVector(size int) bool {
+	_, ok := p.vector(size)
+	return ok
+}
@@ -0,0 +1,296 @@
+package netx
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// clientHello returns the bytes of the client hello message that a TLS client
+// sends with config.
+func clientHello(t *testing.T, config *tls.Config) []byte {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		tls.Client(c1, config).Handshake()
+	}()
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := readTLSClientHello(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReadTLSClientHello(t *testing.T) {
+	tests := []struct {
+		config *tls.Config
+		hello  TLSClientHello
+	}{
+		{
+			config: &tls.Config{ServerName: "example.com"},
+			hello:  TLSClientHello{ServerName: "example.com"},
+		},
+		{
+			config: &tls.Config{ServerName: "www.example.com", NextProtos: []string{"h2", "http/1.1"}},
+			hello:  TLSClientHello{ServerName: "www.example.com", Protocols: []string{"h2", "http/1.1"}},
+		},
+		{
+			// No server name indication is sent for IP addresses.
+			config: &tls.Config{ServerName: "127.0.0.1", InsecureSkipVerify: true},
+			hello:  TLSClientHello{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.config.ServerName, func(t *testing.T) {
+			b := clientHello(t, test.config)
+
+			hello, buf, err := readTLSClientHello(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(hello, test.hello) {
+				t.Errorf("bad client hello:\n- expected: %#v\n- found:    %#v", test.hello, hello)
+			}
+
+			if !bytes.Equal(buf, b) {
+				t.Error("the bytes read from the connection were not all returned")
+			}
+		})
+	}
+}
+
+func TestReadTLSClientHelloFragmented(t *testing.T) {
+	b := clientHello(t, &tls.Config{ServerName: "example.com"})
+	msg := b[5:]
+
+	// Split the handshake message in records of 16 bytes.
+	var f []byte
+
+	for len(msg) != 0 {
+		n := 16
+		if n > len(msg) {
+			n = len(msg)
+		}
+		f = append(f, 22, 3, 1, 0, byte(n))
+		f = append(f, msg[:n]...)
+		msg = msg[n:]
+	}
+
+	hello, buf, err := readTLSClientHello(bytes.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello.ServerName != "example.com" {
+		t.Error("bad server name:", hello.ServerName)
+	}
+
+	if !bytes.Equal(buf, f) {
+		t.Error("the bytes read from the connection were not all returned")
+	}
+}
+
+func TestReadTLSClientHelloError(t *testing.T) {
+	b := clientHello(t, &tls.Config{ServerName: "example.com"})
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"truncated", b[:len(b)-1]},
+		{"header", b[:3]},
+		{"empty-record", []byte{22, 3, 1, 0, 0}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := readTLSClientHello(bytes.NewReader(test.data)); err != errNotTLSClientHello {
+				t.Error("bad error:", err)
+			}
+		})
+	}
+}
+
+func TestTLSRouterHandler(t *testing.T) {
+	named := func(name string) Handler {
+		return &Proxy{Addr: &NetAddr{Addr: name}}
+	}
+
+	router := &TLSRouter{}
+	router.Handle("example.com", named("exact"))
+	router.Handle("*.example.com", named("wildcard"))
+	router.Handle("*.api.example.com", named("api"))
+
+	tests := []struct {
+		serverName string
+		route      string
+	}{
+		{"example.com", "exact"},
+		{"EXAMPLE.com.", "exact"},
+		{"www.example.com", "wildcard"},
+		{"a.b.example.com", "wildcard"},
+		{"v1.api.example.com", "api"},
+		{"api.example.com", "wildcard"},
+		{"example.org", ""},
+		{"", ""},
+	}
+
+	route := func(h Handler) string {
+		if h == nil {
+			return ""
+		}
+		return h.(*Proxy).Addr.String()
+	}
+
+	for _, test := range tests {
+		if r := route(router.Handler(test.serverName)); r != test.route {
+			t.Errorf("%q: bad route: %q != %q", test.serverName, test.route, r)
+		}
+	}
+
+	router.Handle("*", named("default"))
+
+	for _, serverName := range []string{"example.org", ""} {
+		if r := route(router.Handler(serverName)); r != "default" {
+			t.Errorf("%q: bad route: %q", serverName, r)
+		}
+	}
+}
+
+func TestTLSRouterHandlePanic(t *testing.T) {
+	router := &TLSRouter{}
+	router.Handle("example.com", Pass)
+
+	for _, pattern := range []string{"example.com", "", "www.*.com", "*example.com", "*.*.com"} {
+		t.Run(pattern, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			router.Handle(pattern, Pass)
+		})
+	}
+}
+
+func TestTLSRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netx-sni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each route terminates TLS with a certificate named after the route, and
+	// echoes the negotiated protocol.
+	terminate := func(name string) Handler {
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+".key")
+		writeCertificate(t, name, certFile, keyFile)
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			hello, ok := TLSClientHelloOf(conn)
+			if !ok {
+				t.Error("the client hello is not available on the connection")
+			}
+
+			c := tls.Server(conn, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   hello.Protocols,
+			})
+			defer c.Close()
+
+			if err := c.Handshake(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			io.WriteString(c, c.ConnectionState().NegotiatedProtocol)
+		})
+	}
+
+	router := &TLSRouter{}
+	router.Handle("a.example.com", terminate("A"))
+	router.Handle("*.example.com", terminate("B"))
+	router.Handle("*", terminate("C"))
+
+	addr, close := listenAndServe(router)
+	defer close()
+
+	tests := []struct {
+		serverName string
+		cert       string
+	}{
+		{"a.example.com", "A"},
+		{"b.example.com", "B"},
+		{"example.org", "C"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.serverName, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr.String(), &tls.Config{
+				ServerName:         test.serverName,
+				NextProtos:         []string{"netx"},
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != test.cert {
+				t.Error("bad certificate:", name)
+			}
+
+			b, _ := ioutil.ReadAll(conn)
+
+			if s := string(b); s != "netx" {
+				t.Error("bad protocol:", s)
+			}
+		})
+	}
+}
+
+func TestTLSRouterProxy(t *testing.T) {
+	targets := make(chan net.Addr, 1)
+
+	router := &TLSRouter{}
+	router.HandleProxy("*", ProxyHandlerFunc(func(ctx context.Context, conn net.Conn, target net.Addr) {
+		conn.Close()
+		targets <- target
+	}))
+
+	addr, close := listenAndServe(router)
+	defer close()
+
+	_, port, _ := net.SplitHostPort(addr.String())
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+
+	if target := <-targets; target.String() != net.JoinHostPort("example.com", port) || target.Network() != "tcp" {
+		t.Error("bad target address:", target.Network(), target)
+	}
+}
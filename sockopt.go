@@ -0,0 +1,396 @@
+package netx
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A ListenConfig contains options for the sockets created by Listen.
+//
+// The options are applied to every socket that the listener is made of, for
+// example when listening on all addresses of a network interface. Options that
+// don't apply to the type of socket being created are ignored, options that
+// aren't supported on the platform cause an error to be returned.
+//
+// The zero-value is a valid configuration which leaves all sockets options to
+// their default values.
+type ListenConfig struct {
+	// ReusePort is the number of sockets to open on each address with the
+	// SO_REUSEPORT option set, the kernel balances the connections across
+	// them. When set to 1 a single socket is opened, which lets multiple
+	// servers or processes listen on the same address.
+	ReusePort int
+
+	// Backlog is the maximum length of the queue of pending connections. If
+	// zero, the default value picked by the net package is used.
+	Backlog int
+
+	// DeferAccept sets the TCP_DEFER_ACCEPT option, connections are not
+	// accepted until data arrive or the timeout expires (linux only).
+	DeferAccept time.Duration
+
+	// FastOpen sets the TCP_FASTOPEN option to the given queue length (linux
+	// only).
+	FastOpen int
+
+	// KeepAliveIdle, KeepAliveInterval, and KeepAliveCount configure TCP
+	// keep-alive on the accepted connections. Setting any of these enables
+	// keep-alive and disables the default configuration of the net package.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// UserTimeout sets the TCP_USER_TIMEOUT option on the accepted connections
+	// (linux only).
+	UserTimeout time.Duration
+
+	// V6Only sets the IPV6_V6ONLY option on IPv6 sockets.
+	V6Only bool
+
+	// RecvBuffer and SendBuffer set the size of the socket buffers (SO_RCVBUF
+	// and SO_SNDBUF).
+	RecvBuffer int
+	SendBuffer int
+
+	// FreeBind sets the IP_FREEBIND option, allowing to bind to addresses that
+	// are not assigned yet (linux only).
+	FreeBind bool
+
+	// UnlinkStale removes the file of a unix domain socket left by a process
+	// that didn't close its listener before exiting. The function attempts to
+	// connect to the socket first, and only removes it if the connection was
+	// refused.
+	UnlinkStale bool
+
+	// MkdirAll creates the parent directories of unix domain sockets if they
+	// don't exist.
+	MkdirAll bool
+
+	// Mode, Owner, and Group set the file mode and ownership of unix domain
+	// sockets after they were created. Owner and Group may be names or
+	// numeric ids.
+	//
+	// The socket is created with the permissions derived from the umask of
+	// the process, the mode is only applied after that. Programs that must not
+	// let other users connect during this short window should create the
+	// socket in a directory that only the intended users can access.
+	Mode  os.FileMode
+	Owner string
+	Group string
+
+	// KeepOnClose prevents the file of unix domain sockets from being removed
+	// when the listener is closed.
+	KeepOnClose bool
+
+	// Watch makes the listener follow the changes of the addresses of the
+	// network interface that it is bound to, new sockets are created when
+	// addresses are added to the interface, and closed when addresses are
+	// removed. The option is only supported for TCP listeners on addresses
+	// made of a network interface name and a port.
+	Watch bool
+
+	// TLSConfig is the configuration of TLS listeners (tls:// addresses). The
+	// GetCertificate hook of the configuration is called first when set, the
+	// certificate loaded from CertFile and KeyFile is used if it returns no
+	// certificate.
+	TLSConfig *tls.Config
+
+	// CertFile and KeyFile are paths to the PEM encoded certificate and
+	// private key used by TLS listeners. The files are reloaded when they are
+	// modified.
+	CertFile string
+	KeyFile  string
+
+	// HandshakeTimeout is the maximum amount of time allowed for the TLS
+	// handshake of accepted connections, which happens on their first read or
+	// write. The default is 10 seconds.
+	HandshakeTimeout time.Duration
+
+	// AllPorts changes the behavior of Listen when the address contains a
+	// range of ports, by default the listener is bound to the first port of
+	// the range which is free, when AllPorts is true it is bound to every
+	// port of the range.
+	AllPorts bool
+}
+
+// listenQueryOptions maps the names of options that may be set in the query
+// string of addresses to the functions that set them on a ListenConfig.
+var listenQueryOptions = map[string]func(*ListenConfig, string) error{
+	"reuseport":          func(lc *ListenConfig, s string) (err error) { lc.ReusePort, err = parseReusePort(s); return },
+	"backlog":            func(lc *ListenConfig, s string) (err error) { lc.Backlog, err = parseCount(s); return },
+	"defer_accept":       func(lc *ListenConfig, s string) (err error) { lc.DeferAccept, err = parseDuration(s); return },
+	"fastopen":           func(lc *ListenConfig, s string) (err error) { lc.FastOpen, err = parseCount(s); return },
+	"keepalive_idle":     func(lc *ListenConfig, s string) (err error) { lc.KeepAliveIdle, err = parseDuration(s); return },
+	"keepalive_interval": func(lc *ListenConfig, s string) (err error) { lc.KeepAliveInterval, err = parseDuration(s); return },
+	"keepalive_count":    func(lc *ListenConfig, s string) (err error) { lc.KeepAliveCount, err = parseCount(s); return },
+	"user_timeout":       func(lc *ListenConfig, s string) (err error) { lc.UserTimeout, err = parseDuration(s); return },
+	"v6only":             func(lc *ListenConfig, s string) (err error) { lc.V6Only, err = parseFlag(s); return },
+	"rcvbuf":             func(lc *ListenConfig, s string) (err error) { lc.RecvBuffer, err = parseCount(s); return },
+	"sndbuf":             func(lc *ListenConfig, s string) (err error) { lc.SendBuffer, err = parseCount(s); return },
+	"freebind":           func(lc *ListenConfig, s string) (err error) { lc.FreeBind, err = parseFlag(s); return },
+	"unlink":             func(lc *ListenConfig, s string) (err error) { lc.UnlinkStale, err = parseFlag(s); return },
+	"mkdir":              func(lc *ListenConfig, s string) (err error) { lc.MkdirAll, err = parseFlag(s); return },
+	"mode":               func(lc *ListenConfig, s string) (err error) { lc.Mode, err = parseFileMode(s); return },
+	"owner":              func(lc *ListenConfig, s string) (err error) { lc.Owner = s; return },
+	"group":              func(lc *ListenConfig, s string) (err error) { lc.Group = s; return },
+	"keep":               func(lc *ListenConfig, s string) (err error) { lc.KeepOnClose, err = parseFlag(s); return },
+	"watch":              func(lc *ListenConfig, s string) (err error) { lc.Watch, err = parseFlag(s); return },
+	"cert":               func(lc *ListenConfig, s string) (err error) { lc.CertFile = s; return },
+	"key":                func(lc *ListenConfig, s string) (err error) { lc.KeyFile = s; return },
+	"handshake_timeout":  func(lc *ListenConfig, s string) (err error) { lc.HandshakeTimeout, err = parseDuration(s); return },
+	"allports":           func(lc *ListenConfig, s string) (err error) { lc.AllPorts, err = parseFlag(s); return },
+}
+
+// splitListenConfig splits the query string from address and returns a copy of
+// lc with the options it contains.
+func splitListenConfig(address string, lc ListenConfig) (string, ListenConfig, error) {
+	i := strings.LastIndexByte(address, '?')
+	if i < 0 {
+		return address, lc, nil
+	}
+
+	query, err := url.ParseQuery(address[i+1:])
+	if err != nil {
+		return address, lc, errors.New("invalid options in " + address + ": " + err.Error())
+	}
+	address = address[:i]
+
+	for name, values := range query {
+		value := values[len(values)-1]
+		set := listenQueryOptions[name]
+
+		if set == nil {
+			return address, lc, errors.New("unsupported listen option: " + name)
+		}
+
+		if err := set(&lc, value); err != nil {
+			return address, lc, errors.New("invalid " + name + " option: " + value)
+		}
+	}
+
+	return address, lc, nil
+}
+
+func parseReusePort(s string) (int, error) {
+	switch s {
+	case "", "true":
+		return 1, nil
+	case "false":
+		return 0, nil
+	}
+	return parseCount(s)
+}
+
+func parseCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = errors.New("negative value")
+	}
+	return n, err
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = errors.New("negative duration")
+	}
+	return d, err
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err == nil && (m&^uint64(os.ModePerm)) != 0 {
+		err = errors.New("invalid file mode")
+	}
+	return os.FileMode(m), err
+}
+
+func parseFlag(s string) (bool, error) {
+	if len(s) == 0 {
+		return true, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// sockets returns the number of sockets that must be created for a single
+// address.
+func (lc *ListenConfig) sockets() int {
+	if lc.ReusePort > 1 {
+		return lc.ReusePort
+	}
+	return 1
+}
+
+func (lc *ListenConfig) keepAlive() bool {
+	return lc.KeepAliveIdle != 0 || lc.KeepAliveInterval != 0 || lc.KeepAliveCount != 0
+}
+
+// listenSocket creates a listener with the options applied to the socket before
+// it is bound.
+func (lc *ListenConfig) listenSocket(network string, address string) (lstn net.Listener, err error) {
+	if lc.ReusePort != 0 {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			err = errors.New("the reuseport option is not supported on " + network + " sockets")
+			return
+		}
+	}
+
+	config := net.ListenConfig{Control: lc.control}
+
+	if lc.keepAlive() {
+		// The keep-alive options set on the listening socket are inherited by
+		// the accepted connections, the net package must not override them.
+		config.KeepAlive = -1
+	}
+
+	unix := strings.HasPrefix(network, "unix")
+
+	if unix {
+		if err = lc.prepareUnix(network, address); err != nil {
+			return
+		}
+	}
+
+	if lstn, err = config.Listen(context.Background(), network, address); err != nil {
+		return
+	}
+
+	if lc.Backlog > 0 {
+		err = lc.setBacklog(lstn)
+	}
+
+	if unix && err == nil {
+		err = lc.setupUnix(lstn.(*net.UnixListener), address)
+	}
+
+	if err != nil {
+		lstn.Close()
+		lstn = nil
+	}
+
+	return
+}
+
+// setBacklog calls listen(2) again on the socket to change the length of its
+// queue of pending connections.
+func (lc *ListenConfig) setBacklog(lstn net.Listener) (err error) {
+	sc, ok := lstn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	if e := rc.Control(func(fd uintptr) { err = syscall.Listen(int(fd), lc.Backlog) }); e != nil {
+		err = e
+	}
+
+	if err != nil {
+		err = os.NewSyscallError("listen", err)
+	}
+	return
+}
+
+// control is used as the net.ListenConfig.Control function to set the socket
+// options.
+func (lc *ListenConfig) control(network string, address string, c syscall.RawConn) (err error) {
+	if e := c.Control(func(fd uintptr) { err = lc.setsockopt(network, int(fd)) }); e != nil {
+		err = e
+	}
+	return
+}
+
+func (lc *ListenConfig) setsockopt(network string, fd int) error {
+	tcp := strings.HasPrefix(network, "tcp")
+	ipv6 := strings.HasSuffix(network, "6")
+	unix := strings.HasPrefix(network, "unix")
+
+	if lc.ReusePort != 0 {
+		if err := setsockopt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return err
+		}
+	}
+
+	if lc.RecvBuffer != 0 {
+		if err := setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, lc.RecvBuffer); err != nil {
+			return err
+		}
+	}
+
+	if lc.SendBuffer != 0 {
+		if err := setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, lc.SendBuffer); err != nil {
+			return err
+		}
+	}
+
+	if unix {
+		return nil
+	}
+
+	if lc.V6Only && ipv6 {
+		if err := setsockopt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+			return err
+		}
+	}
+
+	if lc.FreeBind {
+		if err := setFreeBind(fd); err != nil {
+			return err
+		}
+	}
+
+	if !tcp {
+		return nil
+	}
+
+	if lc.keepAlive() {
+		if err := setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return err
+		}
+		if err := setKeepAlive(fd, lc.KeepAliveIdle, lc.KeepAliveInterval, lc.KeepAliveCount); err != nil {
+			return err
+		}
+	}
+
+	if lc.DeferAccept != 0 {
+		if err := setDeferAccept(fd, lc.DeferAccept); err != nil {
+			return err
+		}
+	}
+
+	if lc.FastOpen != 0 {
+		if err := setFastOpen(fd, lc.FastOpen); err != nil {
+			return err
+		}
+	}
+
+	if lc.UserTimeout != 0 {
+		if err := setUserTimeout(fd, lc.UserTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setsockopt(fd int, level int, opt int, value int) error {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, level, opt, value))
+}
+
+// seconds converts d to a number of seconds, rounding up.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
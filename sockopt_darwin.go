@@ -0,0 +1,52 @@
+package netx
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	abstractUnixSockets = false
+	soReusePort         = syscall.SO_REUSEPORT
+	tcpKeepIntvl        = 0x101 // missing from the syscall package
+	tcpKeepCnt          = 0x102 // missing from the syscall package
+)
+
+func setKeepAlive(fd int, idle time.Duration, interval time.Duration, count int) error {
+	if idle != 0 {
+		if err := setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPALIVE, seconds(idle)); err != nil {
+			return err
+		}
+	}
+
+	if interval != 0 {
+		if err := setsockopt(fd, syscall.IPPROTO_TCP, tcpKeepIntvl, seconds(interval)); err != nil {
+			return err
+		}
+	}
+
+	if count != 0 {
+		if err := setsockopt(fd, syscall.IPPROTO_TCP, tcpKeepCnt, count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setDeferAccept(fd int, timeout time.Duration) error {
+	return errors.New("the defer_accept option is not supported on darwin")
+}
+
+func setFastOpen(fd int, qlen int) error {
+	return errors.New("the fastopen option is not supported on darwin")
+}
+
+func setUserTimeout(fd int, timeout time.Duration) error {
+	return errors.New("the user_timeout option is not supported on darwin")
+}
+
+func setFreeBind(fd int) error {
+	return errors.New("the freebind option is not supported on darwin")
+}
@@ -0,0 +1,51 @@
+package netx
+
+import (
+	"syscall"
+	"time"
+)
+
+const (
+	abstractUnixSockets = true
+	soReusePort         = 0xf // missing from the syscall package
+	tcpFastOpen         = 0x17
+	tcpUserTimeout      = 0x12
+)
+
+func setKeepAlive(fd int, idle time.Duration, interval time.Duration, count int) error {
+	if idle != 0 {
+		if err := setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, seconds(idle)); err != nil {
+			return err
+		}
+	}
+
+	if interval != 0 {
+		if err := setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, seconds(interval)); err != nil {
+			return err
+		}
+	}
+
+	if count != 0 {
+		if err := setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setDeferAccept(fd int, timeout time.Duration) error {
+	return setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, seconds(timeout))
+}
+
+func setFastOpen(fd int, qlen int) error {
+	return setsockopt(fd, syscall.IPPROTO_TCP, tcpFastOpen, qlen)
+}
+
+func setUserTimeout(fd int, timeout time.Duration) error {
+	return setsockopt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout/time.Millisecond))
+}
+
+func setFreeBind(fd int) error {
+	return setsockopt(fd, syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
+}
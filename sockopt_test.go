@@ -0,0 +1,260 @@
+package netx
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSplitListenConfig(t *testing.T) {
+	tests := []struct {
+		in   string
+		out  string
+		opts ListenConfig
+	}{
+		{
+			in:  "127.0.0.1:4242",
+			out: "127.0.0.1:4242",
+		},
+		{
+			in:   "tcp://:8080?reuseport=8",
+			out:  "tcp://:8080",
+			opts: ListenConfig{ReusePort: 8},
+		},
+		{
+			in:   ":8080?reuseport",
+			out:  ":8080",
+			opts: ListenConfig{ReusePort: 1},
+		},
+		{
+			in:  "tcp://:8080?backlog=1024&defer_accept=5s&fastopen=16",
+			out: "tcp://:8080",
+			opts: ListenConfig{
+				Backlog:     1024,
+				DeferAccept: 5 * time.Second,
+				FastOpen:    16,
+			},
+		},
+		{
+			in:  ":8080?keepalive_idle=1m&keepalive_interval=10s&keepalive_count=3&user_timeout=30s",
+			out: ":8080",
+			opts: ListenConfig{
+				KeepAliveIdle:     time.Minute,
+				KeepAliveInterval: 10 * time.Second,
+				KeepAliveCount:    3,
+				UserTimeout:       30 * time.Second,
+			},
+		},
+		{
+			in:  "[::]:8080?v6only&rcvbuf=65536&sndbuf=32768&freebind=true",
+			out: "[::]:8080",
+			opts: ListenConfig{
+				V6Only:     true,
+				RecvBuffer: 65536,
+				SendBuffer: 32768,
+				FreeBind:   true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			out, opts, err := splitListenConfig(test.in, ListenConfig{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if out != test.out {
+				t.Error("bad address:", out)
+			}
+
+			if opts != test.opts {
+				t.Errorf("bad options: %+v", opts)
+			}
+		})
+	}
+}
+
+func TestSplitListenConfigOverride(t *testing.T) {
+	_, opts, err := splitListenConfig(":8080?backlog=10", ListenConfig{Backlog: 100, RecvBuffer: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts != (ListenConfig{Backlog: 10, RecvBuffer: 4096}) {
+		t.Errorf("bad options: %+v", opts)
+	}
+}
+
+func TestSplitListenConfigError(t *testing.T) {
+	for _, address := range []string{
+		":8080?reuseport=-1",
+		":8080?reuseport=many",
+		":8080?whatever=1",
+		":8080?backlog=-1",
+		":8080?defer_accept=forever",
+		":8080?v6only=maybe",
+	} {
+		t.Run(address, func(t *testing.T) {
+			if _, _, err := splitListenConfig(address, ListenConfig{}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	lstn, err := Listen("tcp://127.0.0.1:0?reuseport=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	addrs, ok := lstn.Addr().(MultiAddr)
+	if !ok {
+		t.Fatalf("bad listener address: %#v", lstn.Addr())
+	}
+
+	if len(addrs) != 4 {
+		t.Fatal("bad number of listeners:", len(addrs))
+	}
+
+	for _, a := range addrs[1:] {
+		if a.String() != addrs[0].String() {
+			t.Error("listeners bound to different addresses:", addrs)
+		}
+	}
+
+	// Another listener can be bound to the same address as long as it also
+	// sets the option.
+	other, err := Listen("tcp://" + addrs[0].String() + "?reuseport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	conn, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	accepted, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
+
+func TestListenShards(t *testing.T) {
+	lstns, err := ListenShards("tcp://127.0.0.1:0?reuseport=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lstns) != 4 {
+		t.Fatal("bad number of listeners:", len(lstns))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each listener is served by its own accept loop.
+	server := &Server{Handler: Echo, Context: ctx}
+
+	for _, l := range lstns[1:] {
+		if l.Addr().String() != lstns[0].Addr().String() {
+			t.Error("listeners bound to different addresses:", l.Addr(), lstns[0].Addr())
+		}
+	}
+
+	for _, l := range lstns {
+		go server.Serve(l)
+	}
+
+	for i := 0; i != 10; i++ {
+		conn, err := net.Dial("tcp", lstns[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 12)
+		io.WriteString(conn, "Hello World!")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Error(err)
+		} else if string(b) != "Hello World!" {
+			t.Error("bad echo:", string(b))
+		}
+
+		conn.Close()
+	}
+}
+
+func TestListenConfig(t *testing.T) {
+	lc := &ListenConfig{
+		Backlog:        16,
+		KeepAliveCount: 4,
+		RecvBuffer:     100000,
+	}
+
+	lstn, err := lc.Listen("tcp://127.0.0.1:0?sndbuf=90000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	f, err := lstn.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, opt := range []struct {
+		name  string
+		level int
+		opt   int
+		value int
+	}{
+		{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 100000},
+		{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, 90000},
+		{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+	} {
+		// Linux doubles the buffer sizes to account for its bookkeeping
+		// overhead, other systems may round them up.
+		v, err := syscall.GetsockoptInt(int(f.Fd()), opt.level, opt.opt)
+
+		switch {
+		case err != nil:
+			t.Error(opt.name, err)
+		case runtime.GOOS == "linux" && opt.opt != syscall.SO_KEEPALIVE && v != 2*opt.value:
+			t.Errorf("%s: bad value: %d != 2 * %d", opt.name, v, opt.value)
+		case v < opt.value:
+			t.Errorf("%s: bad value: %d < %d", opt.name, v, opt.value)
+		}
+	}
+
+	conn, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	accepted, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
+
+func TestListenConfigUnsupportedNetwork(t *testing.T) {
+	if _, err := Listen("unix:///tmp/netx-sockopt.sock?reuseport"); err == nil {
+		t.Error("expected an error when setting reuseport on a unix socket")
+	}
+}
@@ -0,0 +1,178 @@
+package netx
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A ConnState represents the state of a client connection to a server. It is
+// used by the optional Server.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew represents a new connection that was just accepted by the
+	// server, the handler wasn't called yet.
+	StateNew ConnState = iota
+
+	// StateActive represents a connection that the handler is serving.
+	StateActive
+
+	// StateIdle represents a connection that the handler reported as waiting
+	// for more input, for example between two requests of a protocol that
+	// supports keep-alive.
+	StateIdle
+
+	// StateHijacked represents a connection that the handler reported as taken
+	// over by another piece of code. This is a terminal state, it doesn't
+	// transition to StateClosed. The server stops tracking hijacked
+	// connections and doesn't close them when the handler returns.
+	StateHijacked
+
+	// StateClosed represents a closed connection, the handler has returned.
+	// This is a terminal state.
+	StateClosed
+)
+
+var stateName = [...]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateIdle:     "idle",
+	StateHijacked: "hijacked",
+	StateClosed:   "closed",
+}
+
+// String satisfies the fmt.Stringer interface.
+func (s ConnState) String() string {
+	if s >= 0 && int(s) < len(stateName) {
+		return stateName[s]
+	}
+	return "unknown"
+}
+
+// ConnInfo carries information about a connection served by a Server, it is
+// returned by the Server.Conns method.
+type ConnInfo struct {
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
+	State        ConnState
+	Start        time.Time
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// SetConnState reports that conn has transitioned to state. Handlers that know
+// more about the protocol they speak than the server does may call it to
+// signal when a connection becomes idle or gets hijacked.
+//
+// The function has no effect if conn wasn't received from a Server, or is a
+// wrapper which doesn't expose the connection it received through a
+// `BaseConn() net.Conn` method.
+func SetConnState(conn net.Conn, state ConnState) {
+	if c, ok := findConn(conn, isServerConn).(*serverConn); ok {
+		c.setState(state)
+	}
+}
+
+func isServerConn(conn net.Conn) bool {
+	_, ok := conn.(*serverConn)
+	return ok
+}
+
+// serverConn is the net.Conn wrapper that a Server passes to its handler, it
+// records the state of the connection and the number of bytes exchanged.
+type serverConn struct {
+	// The counters are first in the struct to guarantee 64 bits alignment
+	// of the atomic operations on 32 bits platforms.
+	nread  int64
+	nwrite int64
+
+	net.Conn
+	server  *Server
+	slots   chan struct{}  // released when the connection is closed, may be nil
+	limiter *SourceLimiter // released when the connection is closed, may be nil
+	start   time.Time
+	state   int32
+}
+
+func newServerConn(server *Server, conn net.Conn) *serverConn {
+	return &serverConn{
+		Conn:   conn,
+		server: server,
+		start:  time.Now(),
+		state:  int32(StateNew),
+	}
+}
+
+func (c *serverConn) BaseConn() net.Conn {
+	return c.Conn
+}
+
+func (c *serverConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.nread, int64(n))
+	return
+}
+
+func (c *serverConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.nwrite, int64(n))
+	return
+}
+
+func (c *serverConn) release() {
+	if c.slots != nil {
+		<-c.slots
+		c.slots = nil
+	}
+	if c.limiter != nil {
+		c.limiter.Release(c.RemoteAddr())
+		c.limiter = nil
+	}
+}
+
+// closeUnlessHijacked closes c, unless the handler reported that it was taken
+// over by another piece of code which is now responsible for closing it.
+func (c *serverConn) closeUnlessHijacked() {
+	if ConnState(atomic.LoadInt32(&c.state)) != StateHijacked {
+		c.Close()
+	}
+}
+
+func (c *serverConn) info() ConnInfo {
+	return ConnInfo{
+		LocalAddr:    c.LocalAddr(),
+		RemoteAddr:   c.RemoteAddr(),
+		State:        ConnState(atomic.LoadInt32(&c.state)),
+		Start:        c.start,
+		BytesRead:    atomic.LoadInt64(&c.nread),
+		BytesWritten: atomic.LoadInt64(&c.nwrite),
+	}
+}
+
+func (c *serverConn) setState(state ConnState) {
+	for {
+		old := ConnState(atomic.LoadInt32(&c.state))
+
+		switch {
+		case old == state:
+			return
+		case old == StateClosed:
+			return
+		case old == StateHijacked:
+			return
+		}
+
+		if atomic.CompareAndSwapInt32(&c.state, int32(old), int32(state)) {
+			break
+		}
+	}
+
+	if state == StateHijacked {
+		c.server.untrackConn(c)
+	}
+
+	if hook := c.server.ConnState; hook != nil {
+		hook(c, state)
+	}
+}
@@ -0,0 +1,187 @@
+package netx
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnStateString(t *testing.T) {
+	tests := []struct {
+		state ConnState
+		str   string
+	}{
+		{StateNew, "new"},
+		{StateActive, "active"},
+		{StateIdle, "idle"},
+		{StateHijacked, "hijacked"},
+		{StateClosed, "closed"},
+		{ConnState(-1), "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.str, func(t *testing.T) {
+			if s := test.state.String(); s != test.str {
+				t.Error("bad string:", s)
+			}
+		})
+	}
+}
+
+func TestServerConnState(t *testing.T) {
+	lstn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex := sync.Mutex{}
+	states := []ConnState{}
+	closed := make(chan struct{})
+	served := make(chan struct{})
+
+	server := &Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			b := [12]byte{}
+			io.ReadFull(conn, b[:])
+			SetConnState(conn, StateIdle)
+			conn.Write(b[:5])
+			<-ctx.Done()
+		}),
+		ConnState: func(conn net.Conn, state ConnState) {
+			mutex.Lock()
+			states = append(states, state)
+			mutex.Unlock()
+
+			if state == StateClosed {
+				close(closed)
+			}
+		},
+	}
+
+	go func() {
+		defer close(served)
+		server.Serve(lstn)
+	}()
+
+	conn, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "Hello World!"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := [5]byte{}
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := server.Conns()
+
+	if len(conns) != 1 {
+		t.Fatal("bad number of connections:", len(conns))
+	}
+
+	c := conns[0]
+
+	if c.State != StateIdle {
+		t.Error("bad state:", c.State)
+	}
+
+	if c.BytesRead != 12 {
+		t.Error("bad number of bytes read:", c.BytesRead)
+	}
+
+	if c.BytesWritten != 5 {
+		t.Error("bad number of bytes written:", c.BytesWritten)
+	}
+
+	if s := c.RemoteAddr.String(); s != conn.LocalAddr().String() {
+		t.Error("bad remote address:", s)
+	}
+
+	if c.Start.IsZero() || c.Start.After(time.Now()) {
+		t.Error("bad start time:", c.Start)
+	}
+
+	server.Shutdown(context.Background())
+	<-closed
+	<-served
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !reflect.DeepEqual(states, []ConnState{StateNew, StateActive, StateIdle, StateClosed}) {
+		t.Error("bad state transitions:", states)
+	}
+
+	if n := len(server.Conns()); n != 0 {
+		t.Error("connections remain after shutdown:", n)
+	}
+}
+
+func TestServerConnStateHijacked(t *testing.T) {
+	lstn, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hijacked := make(chan net.Conn, 1)
+	served := make(chan struct{})
+
+	server := &Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			SetConnState(conn, StateHijacked)
+			hijacked <- conn
+		}),
+	}
+
+	go func() {
+		defer close(served)
+		server.Serve(lstn)
+	}()
+
+	conn, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := <-hijacked
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The hijacked connection isn't the server's responsibility anymore, the
+	// shutdown must neither wait for it nor close it.
+	if n, err := server.Shutdown(ctx); n != 0 || err != nil {
+		t.Error("bad shutdown:", n, err)
+	}
+	<-served
+
+	if n := len(server.Conns()); n != 0 {
+		t.Error("hijacked connections are still tracked:", n)
+	}
+
+	if _, err := io.WriteString(c, "Hello World!"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := [12]byte{}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b[:]); s != "Hello World!" {
+		t.Error("bad data received over the hijacked connection:", s)
+	}
+}
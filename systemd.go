@@ -0,0 +1,172 @@
+package netx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd, as defined by
+// SD_LISTEN_FDS_START in sd-daemon.h.
+const listenFDsStart = 3
+
+// systemdFiles holds the file descriptors passed to the program by systemd
+// socket activation.
+type systemdFiles struct {
+	once  sync.Once
+	files []*os.File
+	names []string
+	err   error
+}
+
+var systemd systemdFiles
+
+// load reads the LISTEN_PID, LISTEN_FDS, and LISTEN_FDNAMES environment
+// variables the first time it is called, then removes them so they aren't
+// inherited by child processes.
+func (s *systemdFiles) load() {
+	s.once.Do(func() {
+		pid := os.Getenv("LISTEN_PID")
+		fds := os.Getenv("LISTEN_FDS")
+		names := os.Getenv("LISTEN_FDNAMES")
+
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		s.files, s.names, s.err = parseListenFDs(pid, fds, names, os.Getpid(), listenFDsStart)
+	})
+}
+
+// lookup returns the files that were passed under name, or at the index that
+// name represents if it is a number.
+func (s *systemdFiles) lookup(name string) (files []*os.File, err error) {
+	s.load()
+
+	if err = s.err; err != nil {
+		return
+	}
+
+	if i, e := strconv.Atoi(name); e == nil {
+		if i < 0 || i >= len(s.files) {
+			err = fmt.Errorf("systemd://%s: index out of range, %d file descriptors were passed by systemd", name, len(s.files))
+			return
+		}
+		files = s.files[i : i+1]
+		return
+	}
+
+	for i, n := range s.names {
+		if n == name {
+			files = append(files, s.files[i])
+		}
+	}
+
+	if len(files) == 0 {
+		err = fmt.Errorf("systemd://%s: no file descriptors with this name were passed by systemd", name)
+	}
+
+	return
+}
+
+func parseListenFDs(pid string, fds string, names string, getpid int, start int) (files []*os.File, fdnames []string, err error) {
+	if len(pid) == 0 && len(fds) == 0 {
+		return
+	}
+
+	var p, n int
+
+	if p, err = strconv.Atoi(pid); err != nil || p <= 0 {
+		err = fmt.Errorf("invalid LISTEN_PID environment variable: %q", pid)
+		return
+	}
+
+	if p != getpid {
+		// The file descriptors were meant for a different process.
+		return
+	}
+
+	if n, err = strconv.Atoi(fds); err != nil || n < 0 {
+		err = fmt.Errorf("invalid LISTEN_FDS environment variable: %q", fds)
+		return
+	}
+
+	if len(names) != 0 {
+		if fdnames = strings.Split(names, ":"); len(fdnames) != n {
+			err = fmt.Errorf("the LISTEN_FDNAMES environment variable has %d names but LISTEN_FDS is %d", len(fdnames), n)
+			fdnames = nil
+			return
+		}
+	} else {
+		fdnames = make([]string, n)
+		for i := range fdnames {
+			fdnames[i] = "unknown"
+		}
+	}
+
+	files = make([]*os.File, n)
+
+	for i := range files {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+		files[i] = os.NewFile(uintptr(fd), fdnames[i])
+	}
+
+	return
+}
+
+func listenSystemd(name string) (lstn net.Listener, err error) {
+	var files []*os.File
+
+	if files, err = systemd.lookup(name); err != nil {
+		return
+	}
+
+	lstns := make([]net.Listener, 0, len(files))
+
+	for _, f := range files {
+		var l net.Listener
+
+		if l, err = net.FileListener(f); err != nil {
+			for _, l := range lstns {
+				l.Close()
+			}
+			err = fmt.Errorf("systemd://%s: %s", name, err)
+			return
+		}
+
+		lstns = append(lstns, l)
+	}
+
+	if len(lstns) == 1 {
+		lstn = lstns[0]
+	} else {
+		lstn = MultiListener(lstns...)
+	}
+
+	return
+}
+
+func listenPacketSystemd(name string) (conn net.PacketConn, err error) {
+	var files []*os.File
+
+	if files, err = systemd.lookup(name); err != nil {
+		return
+	}
+
+	if len(files) != 1 {
+		err = errors.New("systemd://" + name + ": multiple file descriptors have this name, packet connections can only be created from one")
+		return
+	}
+
+	if conn, err = net.FilePacketConn(files[0]); err != nil {
+		err = fmt.Errorf("systemd://%s: %s", name, err)
+	}
+
+	return
+}
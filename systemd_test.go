@@ -0,0 +1,119 @@
+package netx
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestParseListenFDsError(t *testing.T) {
+	tests := []struct {
+		name  string
+		pid   string
+		fds   string
+		names string
+	}{
+		{
+			name: "invalid pid",
+			pid:  "abc",
+			fds:  "1",
+		},
+		{
+			name: "invalid fds",
+			pid:  "42",
+			fds:  "-1",
+		},
+		{
+			name:  "names mismatch",
+			pid:   "42",
+			fds:   "2",
+			names: "http",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := parseListenFDs(test.pid, test.fds, test.names, 42, 1000); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseListenFDsOtherProcess(t *testing.T) {
+	files, names, err := parseListenFDs("41", "2", "a:b", 42, 1000)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(files) != 0 || len(names) != 0 {
+		t.Error("file descriptors for a different process were returned")
+	}
+}
+
+func TestSystemdLookup(t *testing.T) {
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	f, err := lstn.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &systemdFiles{}
+	s.once.Do(func() {
+		s.files, s.names, s.err = parseListenFDs("42", "1", "http", 42, fd)
+	})
+	defer s.files[0].Close()
+
+	for _, name := range []string{"http", "0"} {
+		t.Run(name, func(t *testing.T) {
+			files, err := s.lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(files) != 1 {
+				t.Fatal("bad number of files:", len(files))
+			}
+
+			l, err := net.FileListener(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			if l.Addr().String() != lstn.Addr().String() {
+				t.Error("bad listener address:", l.Addr())
+			}
+		})
+	}
+
+	for _, name := range []string{"https", "1"} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.lookup(name); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestListenSystemdNotActivated(t *testing.T) {
+	if _, err := Listen("systemd://http"); err == nil {
+		t.Error("expected an error when the program was not started by systemd")
+	}
+
+	if _, err := ListenPacket("sd://0"); err == nil {
+		t.Error("expected an error when the program was not started by systemd")
+	}
+}
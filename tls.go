@@ -0,0 +1,239 @@
+package netx
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the minimum amount of time between two checks for
+// changes of certificate files.
+var certCheckInterval = time.Second
+
+// tlsConfig returns the TLS configuration used by listeners created from lc.
+func (lc *ListenConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if lc.TLSConfig != nil {
+		config = lc.TLSConfig.Clone()
+	}
+
+	if len(lc.CertFile) != 0 || len(lc.KeyFile) != 0 {
+		if len(lc.CertFile) == 0 || len(lc.KeyFile) == 0 {
+			return nil, errors.New("both a certificate and a key file must be set on tls listeners")
+		}
+
+		files := &certFiles{certFile: lc.CertFile, keyFile: lc.KeyFile}
+
+		if _, err := files.certificate(); err != nil {
+			return nil, err
+		}
+
+		hook := config.GetCertificate
+
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hook != nil {
+				if cert, err := hook(hello); cert != nil || err != nil {
+					return cert, err
+				}
+			}
+			return files.certificate()
+		}
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("tls listeners require a certificate, set the cert and key options or a TLS configuration")
+	}
+
+	return config, nil
+}
+
+func (lc *ListenConfig) handshakeTimeout() time.Duration {
+	if lc.HandshakeTimeout != 0 {
+		return lc.HandshakeTimeout
+	}
+	return 10 * time.Second
+}
+
+// certFiles loads a certificate from files, reloading it when they change.
+type certFiles struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (f *certFiles) certificate() (*tls.Certificate, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+
+	if f.cert != nil && now.Sub(f.checked) < certCheckInterval {
+		return f.cert, nil
+	}
+
+	f.checked = now
+	modTime, err := f.lastModified()
+
+	if err == nil && f.cert != nil && modTime.Equal(f.modTime) {
+		return f.cert, nil
+	}
+
+	if err == nil {
+		var cert tls.Certificate
+
+		if cert, err = tls.LoadX509KeyPair(f.certFile, f.keyFile); err == nil {
+			f.cert, f.modTime = &cert, modTime
+			return f.cert, nil
+		}
+	}
+
+	// The files may be in the middle of being updated, the previous
+	// certificate keeps being used until the new one can be loaded.
+	if f.cert != nil {
+		return f.cert, nil
+	}
+
+	return nil, err
+}
+
+func (f *certFiles) lastModified() (t time.Time, err error) {
+	for _, path := range [...]string{f.certFile, f.keyFile} {
+		var fi os.FileInfo
+
+		if fi, err = os.Stat(path); err != nil {
+			return
+		}
+
+		if m := fi.ModTime(); m.After(t) {
+			t = m
+		}
+	}
+	return
+}
+
+// tlsListener is a listener which wraps the connections it accepts in TLS
+// server connections.
+type tlsListener struct {
+	net.Listener
+	config  *tls.Config
+	timeout time.Duration
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsConn{
+		Conn:    tls.Server(conn, l.config),
+		base:    conn,
+		timeout: l.timeout,
+	}, nil
+}
+
+func (l *tlsListener) Addr() net.Addr {
+	return &tlsAddr{l.Listener.Addr()}
+}
+
+// Listeners returns the listener that l wraps, it allows Restart to pass the
+// underlying sockets to a new process.
+func (l *tlsListener) Listeners() []net.Listener {
+	return []net.Listener{l.Listener}
+}
+
+// tlsConn is a TLS connection which performs the handshake on the first read
+// or write, limiting the time that it may take.
+type tlsConn struct {
+	*tls.Conn
+	base    net.Conn
+	timeout time.Duration
+	once    sync.Once
+	err     error
+
+	// Deadlines set by the program, they are restored after the handshake.
+	mutex sync.Mutex
+	rdead time.Time
+	wdead time.Time
+}
+
+func (c *tlsConn) BaseConn() net.Conn { return c.base }
+
+func (c *tlsConn) LocalAddr() net.Addr { return &tlsAddr{c.Conn.LocalAddr()} }
+
+func (c *tlsConn) Handshake() error {
+	c.once.Do(func() {
+		deadline := time.Now().Add(c.timeout)
+
+		c.mutex.Lock()
+		c.Conn.SetReadDeadline(earliest(deadline, c.rdead))
+		c.Conn.SetWriteDeadline(earliest(deadline, c.wdead))
+		c.mutex.Unlock()
+
+		c.err = c.Conn.Handshake()
+
+		c.mutex.Lock()
+		c.Conn.SetReadDeadline(c.rdead)
+		c.Conn.SetWriteDeadline(c.wdead)
+		c.mutex.Unlock()
+	})
+	return c.err
+}
+
+func (c *tlsConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *tlsConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *tlsConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rdead, c.wdead = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *tlsConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rdead = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *tlsConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.wdead = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func earliest(t1 time.Time, t2 time.Time) time.Time {
+	if !t2.IsZero() && t2.Before(t1) {
+		return t2
+	}
+	return t1
+}
+
+// tlsAddr is the address type of TLS listeners and connections, its network
+// is "tls".
+type tlsAddr struct {
+	addr net.Addr
+}
+
+func (a *tlsAddr) Network() string { return "tls" }
+func (a *tlsAddr) String() string  { return a.addr.String() }
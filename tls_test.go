@@ -0,0 +1,218 @@
+package netx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate generates a self-signed certificate for name and writes it
+// to certFile and keyFile.
+func writeCertificate(t *testing.T, name string, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsServerName connects to lstn and returns the common name of the
+// certificate presented by the server.
+func tlsServerName(t *testing.T, lstn net.Listener) string {
+	done := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := lstn.Accept()
+		if err != nil {
+			done <- nil
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		done <- conn
+	}()
+
+	conn, err := tls.Dial("tcp", lstn.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if c := <-done; c == nil {
+		t.Fatal("no connection accepted")
+	} else {
+		c.Close()
+
+		if network := c.LocalAddr().Network(); network != "tls" {
+			t.Error("bad network of the local address:", network)
+		}
+	}
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestListenTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netx-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, "A", certFile, keyFile)
+
+	lstn, err := Listen("tls://127.0.0.1:0?cert=" + certFile + "&key=" + keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	if network := lstn.Addr().Network(); network != "tls" {
+		t.Error("bad network of the listener address:", network)
+	}
+
+	if name := tlsServerName(t, lstn); name != "A" {
+		t.Error("bad certificate:", name)
+	}
+
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+
+	writeCertificate(t, "B", certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	if name := tlsServerName(t, lstn); name != "B" {
+		t.Error("the certificate was not reloaded:", name)
+	}
+}
+
+func TestListenTLSGetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netx-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, "hook", certFile, keyFile)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc := &ListenConfig{
+		TLSConfig: &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+		},
+	}
+
+	lstn, err := lc.Listen("tls://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	if name := tlsServerName(t, lstn); name != "hook" {
+		t.Error("bad certificate:", name)
+	}
+}
+
+func TestListenTLSHandshakeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netx-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, "A", certFile, keyFile)
+
+	lstn, err := Listen("tls://127.0.0.1:0?cert=" + certFile + "&key=" + keyFile + "&handshake_timeout=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	// The client never sends its hello message, Accept must not be blocked.
+	client, err := net.Dial("tcp", lstn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+
+	if _, err := conn.Read(make([]byte, 1)); !IsTimeout(err) {
+		t.Error("expected a timeout error but got", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("the handshake timeout was not applied:", elapsed)
+	}
+}
+
+func TestListenTLSError(t *testing.T) {
+	for _, address := range []string{
+		"tls://127.0.0.1:0",
+		"tls://127.0.0.1:0?cert=/tmp/netx-no-such-cert.pem&key=/tmp/netx-no-such-key.pem",
+		"tls://127.0.0.1:0?cert=/tmp/netx-no-such-cert.pem",
+	} {
+		t.Run(address, func(t *testing.T) {
+			if lstn, err := Listen(address); err == nil {
+				lstn.Close()
+				t.Error("expected an error")
+			}
+		})
+	}
+}
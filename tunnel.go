@@ -38,6 +38,15 @@ type Tunnel struct {
 	// DialContext can be set to a dialing function to configure how the tunnel
 	// establishes new connections.
 	DialContext func(context.Context, string, string) (net.Conn, error)
+
+	// ProxyHeader can be set to make the tunnel send a proxy protocol header
+	// on the connections it establishes, before passing them to its handler.
+	// The version and TLVs of the header are taken from this field, the
+	// source address is the remote address of the connection received by the
+	// tunnel and the destination address is the target it connects to. When
+	// the target isn't made of an IP address and port (a host name for
+	// example), the local address of the connection is used instead.
+	ProxyHeader *ProxyHeader
 }
 
 // ServeProxy satisfies the ProxyHandler interface.
@@ -59,6 +68,20 @@ func (t *Tunnel) ServeProxy(ctx context.Context, from net.Conn, target net.Addr)
 	}
 
 	defer to.Close()
+
+	if t.ProxyHeader != nil {
+		hdr := *t.ProxyHeader
+		hdr.SrcAddr, hdr.DstAddr = from.RemoteAddr(), proxyHeaderAddr(target)
+
+		if hdr.DstAddr == nil {
+			hdr.DstAddr = from.LocalAddr()
+		}
+
+		if _, err := hdr.WriteTo(to); err != nil {
+			panic(err)
+		}
+	}
+
 	t.Handler.ServeTunnel(ctx, from, to)
 }
 
@@ -1,6 +1,7 @@
 package netx
 
 import (
+	"context"
 	"io"
 	"net"
 	"testing"
@@ -60,3 +61,56 @@ func TestTunnel(t *testing.T) {
 		})
 	}
 }
+
+func TestTunnelProxyHeader(t *testing.T) {
+	type result struct {
+		remote string
+		hdr    *ProxyHeader
+	}
+
+	results := make(chan result, 1)
+
+	addr1, close1 := listenAndServe(&ProxyProtocol{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			defer conn.Close()
+			hdr, _ := ProxyHeaderOf(conn)
+			results <- result{remote: conn.RemoteAddr().String(), hdr: hdr}
+		}),
+	})
+	defer close1()
+
+	addr2, close2 := listenAndServe(&Proxy{
+		Addr: addr1,
+		Handler: &Tunnel{
+			Handler: TunnelRaw,
+			ProxyHeader: &ProxyHeader{
+				Version: 2,
+				TLVs: []ProxyTLV{
+					{Type: ProxyTLVAuthority, Value: []byte("example.com")},
+					{Type: ProxyTLVCRC32C, Value: make([]byte, 4)},
+				},
+			},
+		},
+	})
+	defer close2()
+
+	conn, err := net.Dial(addr2.Network(), addr2.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res := <-results
+
+	if res.remote != conn.LocalAddr().String() {
+		t.Errorf("bad remote address: %s != %s", conn.LocalAddr(), res.remote)
+	}
+
+	if res.hdr == nil || res.hdr.Version != 2 || res.hdr.Authority != "example.com" {
+		t.Fatalf("bad proxy protocol header: %#v", res.hdr)
+	}
+
+	if res.hdr.DstAddr.String() != addr1.String() {
+		t.Errorf("bad destination address: %s != %s", addr1, res.hdr.DstAddr)
+	}
+}
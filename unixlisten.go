@@ -0,0 +1,151 @@
+package netx
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// isAbstract returns true if path is a name in the abstract namespace of unix
+// domain sockets.
+func isAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// prepareUnix is called before creating a unix domain socket at path, it
+// creates the parent directories and removes stale sockets if the options
+// were set.
+func (lc *ListenConfig) prepareUnix(network string, path string) error {
+	if isAbstract(path) {
+		if !abstractUnixSockets {
+			return errors.New("unix domain sockets in the abstract namespace are not supported: " + path)
+		}
+		return nil
+	}
+
+	if lc.MkdirAll {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+
+	if lc.UnlinkStale {
+		if err := unlinkStale(network, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupUnix is called after creating a unix domain socket at path to set its
+// file mode and ownership.
+func (lc *ListenConfig) setupUnix(lstn *net.UnixListener, path string) error {
+	if isAbstract(path) {
+		return nil
+	}
+
+	if lc.KeepOnClose {
+		lstn.SetUnlinkOnClose(false)
+	}
+
+	if lc.Mode != 0 {
+		if err := os.Chmod(path, lc.Mode); err != nil {
+			return err
+		}
+	}
+
+	if len(lc.Owner) != 0 || len(lc.Group) != 0 {
+		uid, gid := -1, -1
+
+		if len(lc.Owner) != 0 {
+			id, err := lookupUser(lc.Owner)
+			if err != nil {
+				return err
+			}
+			uid = id
+		}
+
+		if len(lc.Group) != 0 {
+			id, err := lookupGroup(lc.Group)
+			if err != nil {
+				return err
+			}
+			gid = id
+		}
+
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unlinkStale removes the unix domain socket at path if no process is
+// listening on it anymore. The network is the one of the listener about to be
+// created, connecting to a socket of another type would always fail.
+func unlinkStale(network string, path string) error {
+	fi, err := os.Lstat(path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	if (fi.Mode() & os.ModeSocket) == 0 {
+		return errors.New(path + " exists and is not a unix domain socket")
+	}
+
+	conn, err := net.DialTimeout(network, path, time.Second)
+
+	if err == nil {
+		// Another process is listening on the socket, creating the listener
+		// will fail with an error indicating that the address is in use.
+		conn.Close()
+		return nil
+	}
+
+	if isConnRefused(err) {
+		if err = os.Remove(path); os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+func isConnRefused(err error) bool {
+	return syscallError(err) == syscall.ECONNREFUSED
+}
+
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
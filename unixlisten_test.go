@@ -0,0 +1,115 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestListenUnixStale(t *testing.T) {
+	networks := []string{"unix"}
+
+	if runtime.GOOS == "linux" {
+		networks = append(networks, "unixpacket")
+	}
+
+	for _, network := range networks {
+		t.Run(network, func(t *testing.T) {
+			path := "/tmp/netx-" + network + "-stale.sock"
+
+			l, err := net.Listen(network, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			l.Close()
+			defer os.Remove(path)
+
+			if _, err := Listen(network + "://" + path); err == nil {
+				t.Fatal("expected an error when listening on a stale socket without the unlink option")
+			}
+
+			lstn, err := Listen(network + "://" + path + "?unlink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lstn.Close()
+
+			// The socket is now in use and must not be removed.
+			if _, err := Listen(network + "://" + path + "?unlink"); err == nil {
+				t.Error("expected an error when listening on a socket in use")
+			}
+		})
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	const path = "/tmp/netx-unix-not-socket.sock"
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(path)
+
+	if _, err := Listen("unix://" + path + "?unlink"); err == nil {
+		t.Error("expected an error when the path is not a socket")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Error("the file was removed:", err)
+	}
+}
+
+func TestListenUnixFile(t *testing.T) {
+	const dir = "/tmp/netx-unix-file"
+	const path = dir + "/a/b/test.sock"
+	defer os.RemoveAll(dir)
+
+	lstn, err := Listen("unix://" + path + "?mkdir&mode=0600&keep&owner=" + strconv.Itoa(os.Getuid()) + "&group=" + strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := fi.Mode() & os.ModePerm; mode != 0600 {
+		t.Errorf("bad file mode: %o", mode)
+	}
+
+	lstn.Close()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Error("the socket was removed:", err)
+	}
+}
+
+func TestListenUnixAbstract(t *testing.T) {
+	lstn, err := Listen("unix://@netx-unix-abstract")
+
+	if runtime.GOOS != "linux" {
+		if err == nil {
+			lstn.Close()
+			t.Error("expected an error on", runtime.GOOS)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	c1, c2, err := ConnPair("unix://@netx-unix-abstract-pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c2.Close()
+}
@@ -0,0 +1,182 @@
+package netx
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// addrWatcher is implemented by the platform-specific types used to detect
+// changes of the addresses of a network interface.
+type addrWatcher interface {
+	// Wait blocks until the addresses of the interface may have changed, or
+	// the watcher is closed.
+	Wait() error
+
+	// Close releases the resources of the watcher and unblocks calls to Wait.
+	Close() error
+}
+
+// listenWatch is called by Listen when the watch option is set, the address
+// must be the name of a network interface with a port.
+func (lc *ListenConfig) listenWatch(address string) (net.Listener, error) {
+	network, address := SplitNetAddr(address)
+
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("the watch option is not supported on " + network + " sockets")
+	}
+
+	name, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.New("the watch option expects the name of a network interface and a port: " + err.Error())
+	}
+
+	if strings.IndexByte(port, '-') >= 0 {
+		return nil, errors.New("the watch option cannot be used with a range of ports: " + address)
+	}
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := watchAddrs(ifi)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &interfaceListener{
+		DynamicListener: NewDynamicListener(),
+		network:         network,
+		ifi:             ifi,
+		port:            port,
+		config:          lc,
+		watcher:         w,
+		lstns:           make(map[string]net.Listener),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	if err := l.update(); err != nil {
+		w.Close()
+		l.DynamicListener.Close()
+		return nil, err
+	}
+
+	go l.run()
+	return l, nil
+}
+
+// interfaceListener is a compound listener bound to all the addresses of a
+// network interface, which adds and removes listeners when the addresses of the
+// interface change.
+type interfaceListener struct {
+	*DynamicListener
+	network string
+	ifi     *net.Interface
+	port    string
+	config  *ListenConfig
+	watcher addrWatcher
+	lstns   map[string]net.Listener // listeners indexed by host address
+	stop    chan struct{}           // closed by Close to stop the run goroutine
+	done    chan struct{}           // closed when the run goroutine exits
+	once    sync.Once
+}
+
+// Close stops watching the network interface and closes all the listeners.
+func (l *interfaceListener) Close() (err error) {
+	l.once.Do(func() {
+		// The run goroutine may be blocked reporting an error while no
+		// goroutine calls Accept, it must be stopped before waiting for it.
+		close(l.stop)
+		l.watcher.Close()
+		<-l.done
+		err = l.DynamicListener.Close()
+	})
+	return
+}
+
+func (l *interfaceListener) run() {
+	defer close(l.done)
+
+	for l.watcher.Wait() == nil {
+		if err := l.update(); err != nil {
+			select {
+			case l.e <- &ListenerError{Addr: &NetAddr{Net: l.network, Addr: net.JoinHostPort(l.ifi.Name, l.port)}, Err: err}:
+			case <-l.stop:
+				return
+			case <-l.x:
+				return
+			}
+		}
+	}
+}
+
+// update synchronizes the set of listeners with the current addresses of the
+// network interface, it returns the first error that occurred when creating
+// new listeners.
+func (l *interfaceListener) update() (err error) {
+	hosts, err := interfaceHosts(l.network, l.ifi)
+	if err != nil {
+		return
+	}
+
+	current := make(map[string]bool, len(hosts))
+
+	for _, h := range hosts {
+		current[h] = true
+	}
+
+	// Listeners that failed were removed from the compound listener, they
+	// are forgotten so new ones get created for their addresses.
+	active := make(map[net.Listener]bool)
+
+	for _, x := range l.Listeners() {
+		active[x] = true
+	}
+
+	for h, x := range l.lstns {
+		if !active[x] {
+			delete(l.lstns, h)
+		}
+	}
+
+	for h, x := range l.lstns {
+		if !current[h] {
+			l.remove(func(y net.Listener) bool { return x == y })
+			x.Close()
+			delete(l.lstns, h)
+		}
+	}
+
+	for _, h := range hosts {
+		if _, ok := l.lstns[h]; ok {
+			continue
+		}
+
+		x, e := listenAll(l.network, []string{net.JoinHostPort(h, l.port)}, l.config)
+		if e != nil {
+			// The address may not be usable yet (for example while duplicate
+			// address detection is in progress for IPv6 addresses), another
+			// attempt will be made on the next change.
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+
+		if e := l.Add(x); e != nil {
+			x.Close()
+			return e
+		}
+
+		l.lstns[h] = x
+	}
+
+	return
+}
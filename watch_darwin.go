@@ -0,0 +1,36 @@
+package netx
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// pollWatcher checks the addresses of network interfaces periodically since
+// there is no rtnetlink on darwin.
+type pollWatcher struct {
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func watchAddrs(ifi *net.Interface) (addrWatcher, error) {
+	return &pollWatcher{
+		ticker: time.NewTicker(5 * time.Second),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (w *pollWatcher) Wait() error {
+	select {
+	case <-w.ticker.C:
+		return nil
+	case <-w.done:
+		return errors.New("watcher closed")
+	}
+}
+
+func (w *pollWatcher) Close() error {
+	w.ticker.Stop()
+	close(w.done)
+	return nil
+}
@@ -0,0 +1,80 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	rtmgrpIPv4IfAddr = 0x10  // missing from the syscall package
+	rtmgrpIPv6IfAddr = 0x100 // missing from the syscall package
+)
+
+// rtnetlinkWatcher receives notifications of address changes from the kernel
+// over a rtnetlink socket.
+type rtnetlinkWatcher struct {
+	file  *os.File
+	index int
+	buf   []byte
+}
+
+func watchAddrs(ifi *net.Interface) (addrWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	// The socket is non-blocking so the file is registered with the runtime
+	// network poller, which allows Close to interrupt a blocking Read.
+	return &rtnetlinkWatcher{
+		file:  os.NewFile(uintptr(fd), "rtnetlink"),
+		index: ifi.Index,
+		buf:   make([]byte, os.Getpagesize()),
+	}, nil
+}
+
+func (w *rtnetlinkWatcher) Wait() error {
+	for {
+		n, err := w.file.Read(w.buf)
+
+		if err != nil {
+			if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOBUFS {
+				// Notifications were dropped because the socket buffer was
+				// full, some of them may have been for the interface.
+				return nil
+			}
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(w.buf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+				if len(m.Data) < syscall.SizeofIfAddrmsg {
+					continue
+				}
+				if a := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0])); int(a.Index) == w.index {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (w *rtnetlinkWatcher) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,78 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestListenWatchVeth changes the addresses of a veth interface and verifies
+// that the listener follows them, it requires root privileges and the ip
+// command.
+func TestListenWatchVeth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the test must be run as root")
+	}
+
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the ip command is not available")
+	}
+
+	ip := func(args ...string) error {
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			t.Logf("ip %v: %s", args, out)
+		}
+		return err
+	}
+
+	if err := ip("link", "add", "netxw0", "type", "veth", "peer", "name", "netxw1"); err != nil {
+		t.Skip("cannot create a veth interface")
+	}
+	defer ip("link", "del", "netxw0")
+
+	if err := ip("addr", "add", "192.0.2.1/24", "dev", "netxw0"); err != nil {
+		t.Fatal(err)
+	}
+
+	lstn, err := Listen("tcp4://netxw0:0?watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	waitAddrs := func(addrs ...string) {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			a := lstn.Addr().(MultiAddr)
+			ok := len(a) == len(addrs)
+
+			for i := 0; ok && i != len(a); i++ {
+				ok = a[i].(*net.TCPAddr).IP.String() == addrs[i]
+			}
+
+			if ok {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("bad listener address:", a)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitAddrs("192.0.2.1")
+
+	if err := ip("addr", "add", "198.51.100.1/24", "dev", "netxw0"); err != nil {
+		t.Fatal(err)
+	}
+	waitAddrs("192.0.2.1", "198.51.100.1")
+
+	if err := ip("addr", "del", "192.0.2.1/24", "dev", "netxw0"); err != nil {
+		t.Fatal(err)
+	}
+	waitAddrs("198.51.100.1")
+}
@@ -0,0 +1,107 @@
+package netx
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenWatchError(t *testing.T) {
+	for _, address := range []string{
+		"udp://lo:0?watch",
+		"127.0.0.1:0?watch",
+		"netx-no-such-interface:0?watch",
+		"lo:9000-9001?watch",
+	} {
+		t.Run(address, func(t *testing.T) {
+			if lstn, err := Listen(address); err == nil {
+				lstn.Close()
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestListenWatch(t *testing.T) {
+	ifi := loopbackInterface(t)
+
+	lstn, err := Listen("tcp4://" + ifi.Name + ":0?watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, ok := lstn.Addr().(MultiAddr); !ok || len(a) == 0 {
+		t.Error("bad listener address:", lstn.Addr())
+	}
+
+	if err := lstn.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := lstn.Accept(); err == nil {
+		t.Error("expected an error after closing the listener")
+	}
+}
+
+func TestListenWatchCloseAfterError(t *testing.T) {
+	ifi := loopbackInterface(t)
+
+	// Taking the port on the loopback address makes the creation of the
+	// listeners fail when the watcher reports a change.
+	taken, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	_, port, _ := net.SplitHostPort(taken.Addr().String())
+	w := &testWatcher{changes: make(chan struct{}, 1), closed: make(chan struct{})}
+
+	l := &interfaceListener{
+		DynamicListener: NewDynamicListener(),
+		network:         "tcp4",
+		ifi:             ifi,
+		port:            port,
+		config:          &ListenConfig{},
+		watcher:         w,
+		lstns:           make(map[string]net.Listener),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	go l.run()
+
+	// Nothing calls Accept, the error of the update stays pending.
+	w.changes <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- l.Close() }()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the listener to be closed")
+	}
+}
+
+// testWatcher is an implementation of addrWatcher which reports the changes
+// published on its channel.
+type testWatcher struct {
+	changes chan struct{}
+	closed  chan struct{}
+}
+
+func (w *testWatcher) Wait() error {
+	select {
+	case <-w.changes:
+		return nil
+	case <-w.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (w *testWatcher) Close() error {
+	close(w.closed)
+	return nil
+}